@@ -0,0 +1,152 @@
+package regrid
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+)
+
+// ListBuckets returns the names of the buckets in the database, a bucket is
+// recognised by its files and chunks tables.
+func ListBuckets(session *r.Session, databaseName string) ([]string, error) {
+	cur, err := r.DB(databaseName).TableList().Run(session)
+	if err != nil {
+		return nil, wrapError("listbuckets", "", "", err)
+	}
+
+	tables := []string{}
+	if err := cur.All(&tables); err != nil {
+		return nil, wrapError("listbuckets", "", "", err)
+	}
+
+	buckets := []string{}
+	for _, table := range tables {
+		if !strings.HasSuffix(table, "_files") {
+			continue
+		}
+
+		name := strings.TrimSuffix(table, "_files")
+		if containsString(tables, name+"_chunks") {
+			buckets = append(buckets, name)
+		}
+	}
+	sort.Strings(buckets)
+
+	return buckets, nil
+}
+
+type DropOptions struct {
+	// ConfirmBucketName must be set to the name of the bucket, this guards
+	// against dropping the wrong bucket.
+	ConfirmBucketName string
+}
+
+// Drop deletes the bucket's tables and every file stored in them.
+func (b *Bucket) Drop(options DropOptions) (err error) {
+	defer b.observe("drop", time.Now(), &err)
+
+	return wrapError("drop", "", "", b.drop(options))
+}
+
+func (b *Bucket) drop(options DropOptions) error {
+	if options.ConfirmBucketName != b.bucketName {
+		return ErrInvalid
+	}
+
+	cur, err := r.DB(b.databaseName).TableList().Run(b.exec("table_list", "", ""))
+	if err != nil {
+		return err
+	}
+
+	tables := []string{}
+	if err := cur.All(&tables); err != nil {
+		return err
+	}
+
+	for _, table := range []string{b.filesTable, b.chunksTable, b.leasesTable, b.blobsTable, b.configTable, b.headsTable} {
+		if !containsString(tables, table) {
+			continue
+		}
+		if err := r.DB(b.databaseName).TableDrop(table).Exec(b.exec("table_drop", table, "")); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type BucketStats struct {
+	// Files is the number of files in each status.
+	Files map[Status]int
+	// Filenames is the number of distinct filenames with a complete revision
+	// and Revisions the number of complete revisions.
+	Filenames int
+	Revisions int
+	// Bytes is the total length of the complete revisions.
+	Bytes int64
+	// Chunks is the number of stored chunks.
+	Chunks int
+}
+
+// Stats returns counts describing the content of the bucket.
+func (b *Bucket) Stats() (_ *BucketStats, err error) {
+	defer b.observe("stats", time.Now(), &err)
+
+	stats, err := b.stats()
+	if err != nil {
+		return nil, wrapError("stats", "", "", err)
+	}
+
+	return stats, nil
+}
+
+func (b *Bucket) stats() (*BucketStats, error) {
+	if err := b.ensureConfig(); err != nil {
+		return nil, err
+	}
+
+	files := b.readTable(b.filesTable)
+	complete := files.Between(
+		[]interface{}{StatusComplete, r.MinVal},
+		[]interface{}{StatusComplete, r.MaxVal},
+	).OptArgs(r.BetweenOpts{
+		Index: fileIndexName,
+	})
+
+	var rsp struct {
+		Statuses []struct {
+			Status Status `gorethink:"group"`
+			Count  int    `gorethink:"reduction"`
+		} `gorethink:"statuses"`
+		Filenames int   `gorethink:"filenames"`
+		Revisions int   `gorethink:"revisions"`
+		Bytes     int64 `gorethink:"bytes"`
+		Chunks    int   `gorethink:"chunks"`
+	}
+	// Distinct over the index streams the filenames, unlike Distinct over the
+	// documents which is limited to the size of an array
+	if err := r.Expr(map[string]interface{}{
+		"statuses":  files.Group("status").Count().Ungroup(),
+		"filenames": files.Distinct(r.DistinctOpts{Index: filenameIndexName}).Filter(r.Row.Nth(0).Eq(StatusComplete)).Count(),
+		"revisions": complete.Count(),
+		"bytes":     complete.Sum("length"),
+		"chunks":    b.readTable(b.chunksTable).Count(),
+	}).ReadOne(&rsp, b.exec("stats", b.filesTable, "")); err != nil {
+		return nil, err
+	}
+
+	stats := &BucketStats{
+		Files:     map[Status]int{},
+		Filenames: rsp.Filenames,
+		Revisions: rsp.Revisions,
+		Bytes:     rsp.Bytes,
+		Chunks:    rsp.Chunks,
+	}
+	for _, status := range rsp.Statuses {
+		stats.Files[status.Status] = status.Count
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,68 @@
+package regrid
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucketAdmin(t *testing.T) {
+	bucket := New(session, BucketOptions{
+		DatabaseName:   db,
+		BucketName:     "admin",
+		ChunkSizeBytes: 4,
+	})
+	require.Nil(t, bucket.Init())
+
+	var ids []string
+	for _, upload := range []struct {
+		filename, content string
+	}{
+		{"/docs/a.txt", "lorem"},
+		{"/docs/a.txt", "lorem ipsum"},
+		{"/docs/b.txt", "dolor"},
+	} {
+		dst, err := bucket.Create(upload.filename, nil)
+		require.Nil(t, err)
+		_, err = dst.Write([]byte(upload.content))
+		require.Nil(t, err)
+		require.Nil(t, dst.Close())
+		ids = append(ids, dst.ID)
+	}
+	require.Nil(t, bucket.Delete(ids[2]))
+
+	t.Run("ListBuckets", func(t *testing.T) {
+		buckets, err := ListBuckets(session, db)
+		require.Nil(t, err)
+		assert.Contains(t, buckets, "admin")
+	})
+
+	t.Run("Stats", func(t *testing.T) {
+		stats, err := bucket.Stats()
+		require.Nil(t, err)
+		assert.Equal(t, map[Status]int{
+			StatusComplete: 2,
+			StatusDeleted:  1,
+		}, stats.Files)
+		assert.Equal(t, 1, stats.Filenames)
+		assert.Equal(t, 2, stats.Revisions)
+		assert.Equal(t, int64(16), stats.Bytes)
+		assert.Equal(t, 2+3+2, stats.Chunks)
+	})
+
+	t.Run("Drop", func(t *testing.T) {
+		assert.True(t, errors.Is(bucket.Drop(DropOptions{}), ErrInvalid))
+		assert.True(t, errors.Is(bucket.Drop(DropOptions{ConfirmBucketName: "fs"}), ErrInvalid))
+
+		require.Nil(t, bucket.Drop(DropOptions{ConfirmBucketName: "admin"}))
+
+		buckets, err := ListBuckets(session, db)
+		require.Nil(t, err)
+		assert.NotContains(t, buckets, "admin")
+
+		_, err = bucket.Stat("/docs/a.txt")
+		assert.True(t, errors.Is(err, ErrNotInitialized))
+	})
+}
@@ -1,16 +1,116 @@
 package regrid
 
-import r "github.com/dancannon/gorethink"
+import (
+	"time"
+
+	r "github.com/dancannon/gorethink"
+)
 
 const (
-	fileIndexName  = "file_ix"
-	chunkIndexName = "chunk_ix"
+	fileIndexName     = "file_ix"
+	filenameIndexName = "filename_ix"
+	chunkIndexName    = "chunk_ix"
+	blobIndexName     = "blob_ix"
+	hashIndexName     = "sha256_ix"
+	dataIndexName     = "data_ix"
 )
 
 type BucketOptions struct {
 	DatabaseName   string
 	BucketName     string
 	ChunkSizeBytes int
+	// Chunking selects how content is split into chunks. With ChunkingFastCDC
+	// ChunkSizeBytes is the average chunk size and the minimum and maximum
+	// default to a quarter and four times the average.
+	Chunking          Chunking
+	MinChunkSizeBytes int
+	MaxChunkSizeBytes int
+	Compression       Compression
+	// KeyProvider enables encryption of the chunk data of new files.
+	KeyProvider KeyProvider
+	// DedupeChunks stores chunk data once per distinct content in a blobs
+	// table, it cannot be combined with KeyProvider.
+	DedupeChunks bool
+	// DedupeFiles makes a completed upload share the chunks of an existing
+	// complete file with the same SHA-256 hash, discarding its own chunks.
+	DedupeFiles bool
+	// InlineThresholdBytes stores files no larger than this many bytes in
+	// the files document instead of in chunks. Inline storage is disabled
+	// when a KeyProvider is set.
+	InlineThresholdBytes int
+	// Hashes lists the hashes calculated when writing a file in addition to
+	// SHA-256, VerifyHashes lists the hashes checked when reading a file and
+	// defaults to SHA-256.
+	Hashes       []HashAlgorithm
+	VerifyHashes []HashAlgorithm
+	// Shards, Replicas, PrimaryReplicaTag and Durability configure the tables
+	// which store files and chunk data, zero values use the server defaults.
+	// They are applied when the tables are created and reconciled when Init
+	// runs against existing tables. When PrimaryReplicaTag is set all
+	// replicas are placed on servers with that tag.
+	Shards            int
+	Replicas          int
+	PrimaryReplicaTag string
+	Durability        Durability
+	// ReadMode is used when reading files and listing or counting them, it
+	// can be changed for individual calls with WithReadMode.
+	ReadMode ReadMode
+	// Retry retries chunk inserts and chunk reads which fail with a transient
+	// error, by default they are not retried.
+	Retry RetryPolicy
+	// ReadLimiter and WriteLimiter limit the rate at which chunks are read
+	// and written by all files of the bucket, the same Limiter may be used
+	// for both.
+	ReadLimiter  *Limiter
+	WriteLimiter *Limiter
+	// Metrics records the operations of the bucket, see NewExpvarMetrics
+	// and NewPrometheusMetrics.
+	Metrics Metrics
+	// QueryHooks are invoked around every query, see SlogHook and
+	// TracingHook.
+	QueryHooks []QueryHook
+	// Cache keeps the content of chunks read from complete files so that
+	// hot files are served without querying the chunks table, see
+	// NewMemoryCache and NewDiskCache.
+	Cache ChunkCache
+}
+
+// ReadMode selects the consistency of reads in a cluster.
+type ReadMode string
+
+const (
+	// ReadModeDefault reads from the primary replica, equivalent to
+	// ReadModeSingle.
+	ReadModeDefault ReadMode = ""
+	ReadModeSingle  ReadMode = "single"
+	// ReadModeMajority only returns data which is safely committed to a
+	// majority of replicas.
+	ReadModeMajority ReadMode = "majority"
+	// ReadModeOutdated reads from any replica and may return stale data.
+	ReadModeOutdated ReadMode = "outdated"
+)
+
+func (m ReadMode) valid() bool {
+	switch m {
+	case ReadModeDefault, ReadModeSingle, ReadModeMajority, ReadModeOutdated:
+		return true
+	}
+
+	return false
+}
+
+// Durability controls whether writes are acknowledged before or after they
+// are flushed to disk.
+type Durability string
+
+const (
+	DurabilityDefault Durability = ""
+	DurabilityHard    Durability = "hard"
+	DurabilitySoft    Durability = "soft"
+)
+
+func (d Durability) valid() bool {
+	return d == DurabilityDefault || d == DurabilityHard || d == DurabilitySoft
 }
 
 type Bucket struct {
@@ -18,7 +118,29 @@ type Bucket struct {
 
 	databaseName, bucketName string
 	chunkSizeBytes           int
+	chunking                 Chunking
+	minChunkSizeBytes        int
+	maxChunkSizeBytes        int
+	compression              Compression
+	keyProvider              KeyProvider
+	dedupeChunks             bool
+	dedupeFiles              bool
+	inlineThresholdBytes     int
+	hashes, verifyHashes     []HashAlgorithm
+	shards, replicas         int
+	primaryReplicaTag        string
+	durability               Durability
+	readMode                 ReadMode
+	retry                    RetryPolicy
+	readLimiter              *Limiter
+	writeLimiter             *Limiter
+	metrics                  Metrics
+	queryHooks               []QueryHook
+	cache                    ChunkCache
+	configCheck              *configCheck
 	filesTable, chunksTable  string
+	leasesTable, blobsTable  string
+	configTable, headsTable  string
 }
 
 func New(session *r.Session, options BucketOptions) *Bucket {
@@ -28,19 +150,103 @@ func New(session *r.Session, options BucketOptions) *Bucket {
 	if options.ChunkSizeBytes == 0 {
 		options.ChunkSizeBytes = 1024 * 255
 	}
+	if len(options.VerifyHashes) == 0 {
+		options.VerifyHashes = []HashAlgorithm{HashSha256}
+	}
+	if options.Metrics == nil {
+		options.Metrics = nopMetrics{}
+	}
 
 	return &Bucket{
 		session: session,
 
-		databaseName:   options.DatabaseName,
-		bucketName:     options.BucketName,
-		chunkSizeBytes: options.ChunkSizeBytes,
-		filesTable:     options.BucketName + "_files",
-		chunksTable:    options.BucketName + "_chunks",
+		databaseName:         options.DatabaseName,
+		bucketName:           options.BucketName,
+		chunkSizeBytes:       options.ChunkSizeBytes,
+		chunking:             options.Chunking,
+		minChunkSizeBytes:    options.MinChunkSizeBytes,
+		maxChunkSizeBytes:    options.MaxChunkSizeBytes,
+		compression:          options.Compression,
+		keyProvider:          options.KeyProvider,
+		dedupeChunks:         options.DedupeChunks,
+		dedupeFiles:          options.DedupeFiles,
+		inlineThresholdBytes: options.InlineThresholdBytes,
+		hashes:               options.Hashes,
+		verifyHashes:         options.VerifyHashes,
+		shards:               options.Shards,
+		replicas:             options.Replicas,
+		primaryReplicaTag:    options.PrimaryReplicaTag,
+		durability:           options.Durability,
+		readMode:             options.ReadMode,
+		retry:                options.Retry,
+		readLimiter:          options.ReadLimiter,
+		writeLimiter:         options.WriteLimiter,
+		metrics:              options.Metrics,
+		queryHooks:           options.QueryHooks,
+		cache:                options.Cache,
+		filesTable:           options.BucketName + "_files",
+		chunksTable:          options.BucketName + "_chunks",
+		leasesTable:          options.BucketName + "_leases",
+		blobsTable:           options.BucketName + "_blobs",
+		configTable:          options.BucketName + "_config",
+		headsTable:           options.BucketName + "_heads",
+		configCheck:          &configCheck{},
+	}
+}
+
+// WithReadMode returns a copy of the bucket which reads with the given read
+// mode, including when reading the chunks of files it opens. It returns
+// ErrInvalid if the read mode is not supported.
+func (b *Bucket) WithReadMode(mode ReadMode) (*Bucket, error) {
+	if !mode.valid() {
+		return nil, wrapError("withreadmode", "", "", ErrInvalid)
 	}
+
+	c := *b
+	c.readMode = mode
+
+	return &c, nil
 }
 
-func (b *Bucket) Init() error {
+// readTable returns the table for queries which only read, using the read
+// mode of the bucket.
+func (b *Bucket) readTable(table string) r.Term {
+	if b.readMode == ReadModeDefault {
+		return r.DB(b.databaseName).Table(table)
+	}
+
+	return r.DB(b.databaseName).Table(table, r.TableOpts{
+		ReadMode: string(b.readMode),
+	})
+}
+
+// durability returns the durability optarg for a write, nil leaves the
+// durability of the table in effect.
+func durability(d Durability) interface{} {
+	if d == DurabilityDefault {
+		return nil
+	}
+
+	return string(d)
+}
+
+func (b *Bucket) Init() (err error) {
+	defer b.observe("init", time.Now(), &err)
+
+	return wrapError("init", "", "", b.init())
+}
+
+func (b *Bucket) init() error {
+	if b.dedupeChunks && b.keyProvider != nil {
+		return ErrInvalid
+	}
+	if b.shards < 0 || b.replicas < 0 || !b.durability.valid() || !b.readMode.valid() {
+		return ErrInvalid
+	}
+	if b.retry.Backoff < 0 || b.retry.MaxBackoff < 0 {
+		return ErrInvalid
+	}
+
 	if err := b.createTables(); err != nil {
 		return err
 	}
@@ -51,11 +257,11 @@ func (b *Bucket) Init() error {
 		return err
 	}
 
-	return nil
+	return b.checkConfig()
 }
 
 func (b *Bucket) createTables() error {
-	cur, err := r.DB(b.databaseName).TableList().Run(b.session)
+	cur, err := r.DB(b.databaseName).TableList().Run(b.exec("table_list", "", ""))
 	if err != nil {
 		return err
 	}
@@ -65,24 +271,29 @@ func (b *Bucket) createTables() error {
 		return err
 	}
 
-	filesTableExists := false
-	chunksTableExists := false
-	for _, table := range tables {
-		if table == b.filesTable {
-			filesTableExists = true
-		}
-		if table == b.chunksTable {
-			chunksTableExists = true
-		}
+	required := []string{b.filesTable, b.chunksTable, b.leasesTable, b.configTable, b.headsTable}
+	if b.dedupeChunks {
+		required = append(required, b.blobsTable)
 	}
 
-	if !filesTableExists {
-		if err := r.DB(b.databaseName).TableCreate(b.filesTable).Exec(b.session); err != nil {
-			return err
+	for _, table := range required {
+		// Only the tables holding file data use the configured layout
+		configured := table != b.leasesTable && table != b.configTable && table != b.headsTable
+
+		if containsString(tables, table) {
+			if configured {
+				if err := b.reconfigureTable(table); err != nil {
+					return err
+				}
+			}
+			continue
 		}
-	}
-	if !chunksTableExists {
-		if err := r.DB(b.databaseName).TableCreate(b.chunksTable).Exec(b.session); err != nil {
+
+		opts := r.TableCreateOpts{}
+		if configured {
+			opts = b.tableCreateOpts()
+		}
+		if err := r.DB(b.databaseName).TableCreate(table, opts).Exec(b.exec("table_create", table, "")); err != nil {
 			return err
 		}
 	}
@@ -90,41 +301,170 @@ func (b *Bucket) createTables() error {
 	return nil
 }
 
-func (b *Bucket) createFilesIndexes() error {
-	cur, err := r.DB(b.databaseName).Table(b.filesTable).IndexList().Run(b.session)
-	if err != nil {
-		return err
+func (b *Bucket) tableCreateOpts() r.TableCreateOpts {
+	opts := r.TableCreateOpts{}
+	if b.shards > 0 {
+		opts.Shards = b.shards
+	}
+	if b.primaryReplicaTag != "" {
+		opts.PrimaryReplicaTag = b.primaryReplicaTag
+		replicas := b.replicas
+		if replicas == 0 {
+			replicas = 1
+		}
+		opts.Replicas = map[string]int{b.primaryReplicaTag: replicas}
+	} else if b.replicas > 0 {
+		opts.Replicas = b.replicas
+	}
+	if b.durability != DurabilityDefault {
+		opts.Durability = string(b.durability)
 	}
 
-	indexes := []string{}
-	if err := cur.All(&indexes); err != nil {
+	return opts
+}
+
+type tableConfig struct {
+	Durability Durability `gorethink:"durability"`
+	Shards     []struct {
+		PrimaryReplica string   `gorethink:"primary_replica"`
+		Replicas       []string `gorethink:"replicas"`
+	} `gorethink:"shards"`
+}
+
+// reconfigureTable brings an existing table in line with the configured
+// sharding, replication and durability, leaving settings which are not
+// configured as they are.
+func (b *Bucket) reconfigureTable(table string) error {
+	if b.shards == 0 && b.replicas == 0 && b.primaryReplicaTag == "" && b.durability == DurabilityDefault {
+		return nil
+	}
+
+	var config tableConfig
+	if err := r.DB(b.databaseName).Table(table).Config().ReadOne(&config, b.exec("table_config", table, "")); err != nil {
 		return err
 	}
 
-	indexExists := false
-	for _, index := range indexes {
-		if index == fileIndexName {
-			indexExists = true
+	shards, replicas := len(config.Shards), 0
+	if shards > 0 {
+		replicas = len(config.Shards[0].Replicas)
+	}
+	reconfigure := (b.shards > 0 && b.shards != shards) || (b.replicas > 0 && b.replicas != replicas)
+	if !reconfigure && b.primaryReplicaTag != "" {
+		servers, err := b.taggedServers(b.primaryReplicaTag)
+		if err != nil {
+			return err
 		}
+		reconfigure = !config.placedOn(servers)
 	}
+	if reconfigure {
+		opts := r.ReconfigureOpts{
+			Shards:   shards,
+			Replicas: replicas,
+		}
+		if b.shards > 0 {
+			opts.Shards = b.shards
+		}
+		if b.replicas > 0 {
+			opts.Replicas = b.replicas
+		}
+		if b.primaryReplicaTag != "" {
+			opts.PrimaryReplicaTag = b.primaryReplicaTag
+			opts.Replicas = map[string]int{b.primaryReplicaTag: opts.Replicas.(int)}
+		}
 
-	if !indexExists {
-		if err := r.DB(b.databaseName).Table(b.filesTable).IndexCreateFunc(fileIndexName, []interface{}{
-			r.Row.AtIndex("status"), r.Row.AtIndex("filename"), r.Row.AtIndex("finishedAt"),
-		}).Exec(b.session); err != nil {
+		if err := r.DB(b.databaseName).Table(table).Reconfigure(opts).Exec(b.exec("table_reconfigure", table, "")); err != nil {
+			return err
+		}
+		if err := r.DB(b.databaseName).Table(table).Wait().Exec(b.exec("table_wait", table, "")); err != nil {
 			return err
 		}
 	}
 
-	if err := r.DB(b.databaseName).Table(b.filesTable).IndexWait(fileIndexName).Exec(b.session); err != nil {
-		return err
+	if b.durability != DurabilityDefault && b.durability != config.Durability {
+		return r.DB(b.databaseName).Table(table).Config().Update(map[string]interface{}{
+			"durability": b.durability,
+		}).Exec(b.exec("table_config_update", table, ""))
 	}
 
 	return nil
 }
 
+// placedOn reports whether every replica of the table is on one of the given
+// servers.
+func (c tableConfig) placedOn(servers []string) bool {
+	for _, shard := range c.Shards {
+		if !containsString(servers, shard.PrimaryReplica) {
+			return false
+		}
+		for _, replica := range shard.Replicas {
+			if !containsString(servers, replica) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// taggedServers returns the names of the servers with the given tag.
+func (b *Bucket) taggedServers(tag string) ([]string, error) {
+	cur, err := r.DB("rethinkdb").Table("server_config").Filter(
+		r.Row.Field("tags").Contains(tag),
+	).Field("name").Run(b.exec("server_list", "server_config", ""))
+	if err != nil {
+		return nil, err
+	}
+
+	servers := []string{}
+	if err := cur.All(&servers); err != nil {
+		return nil, err
+	}
+
+	return servers, nil
+}
+
+func (b *Bucket) createFilesIndexes() error {
+	if err := b.createIndex(b.filesTable, fileIndexName, []interface{}{
+		r.Row.AtIndex("status"), r.Row.AtIndex("filename"), r.Row.AtIndex("finishedAt"),
+	}); err != nil {
+		return err
+	}
+	if err := b.createFilenameIndex(); err != nil {
+		return err
+	}
+	if err := b.createIndex(b.filesTable, hashIndexName, []interface{}{
+		r.Row.AtIndex("status"), r.Row.AtIndex("sha256"),
+	}); err != nil {
+		return err
+	}
+
+	return b.createIndex(b.filesTable, dataIndexName, r.Row.AtIndex("dataId"))
+}
+
+// createFilenameIndex creates the index used to count distinct filenames, it
+// is also a migration so that older layouts are reported as outdated.
+func (b *Bucket) createFilenameIndex() error {
+	return b.createIndex(b.filesTable, filenameIndexName, []interface{}{
+		r.Row.AtIndex("status"), r.Row.AtIndex("filename"),
+	})
+}
+
 func (b *Bucket) createChunksIndexes() error {
-	cur, err := r.DB(b.databaseName).Table(b.chunksTable).IndexList().Run(b.session)
+	if err := b.createIndex(b.chunksTable, chunkIndexName, []interface{}{
+		r.Row.AtIndex("file_id"), r.Row.AtIndex("num"),
+	}); err != nil {
+		return err
+	}
+
+	if b.dedupeChunks {
+		return b.createIndex(b.chunksTable, blobIndexName, r.Row.AtIndex("blobId"))
+	}
+
+	return nil
+}
+
+func (b *Bucket) createIndex(table, name string, indexFunc interface{}) error {
+	cur, err := r.DB(b.databaseName).Table(table).IndexList().Run(b.exec("index_list", table, ""))
 	if err != nil {
 		return err
 	}
@@ -134,24 +474,25 @@ func (b *Bucket) createChunksIndexes() error {
 		return err
 	}
 
-	indexExists := false
-	for _, index := range indexes {
-		if index == chunkIndexName {
-			indexExists = true
-		}
-	}
-
-	if !indexExists {
-		if err := r.DB(b.databaseName).Table(b.chunksTable).IndexCreateFunc(chunkIndexName, []interface{}{
-			r.Row.AtIndex("file_id"), r.Row.AtIndex("num"),
-		}).Exec(b.session); err != nil {
+	if !containsString(indexes, name) {
+		if err := r.DB(b.databaseName).Table(table).IndexCreateFunc(name, indexFunc).Exec(b.exec("index_create", table, "")); err != nil {
 			return err
 		}
 	}
 
-	if err := r.DB(b.databaseName).Table(b.chunksTable).IndexWait(chunkIndexName).Exec(b.session); err != nil {
+	if err := r.DB(b.databaseName).Table(table).IndexWait(name).Exec(b.exec("index_wait", table, "")); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,6 +1,8 @@
 package regrid
 
 import (
+	"context"
+	"errors"
 	"math/rand"
 	"strconv"
 	"testing"
@@ -30,6 +32,81 @@ func TestBucketInit(t *testing.T) {
 	})
 }
 
+func TestBucketInitTableConfig(t *testing.T) {
+	bucket := New(session, BucketOptions{
+		DatabaseName: db,
+		BucketName:   "table_config",
+		Shards:       2,
+		Replicas:     1,
+		Durability:   DurabilitySoft,
+	})
+	require.Nil(t, bucket.Init())
+
+	for _, table := range []string{"table_config_files", "table_config_chunks"} {
+		var config tableConfig
+		require.Nil(t, r.DB(db).Table(table).Config().ReadOne(&config, session))
+		assert.Len(t, config.Shards, 2)
+		assert.Equal(t, DurabilitySoft, config.Durability)
+	}
+
+	// Init against the existing tables reconciles the configuration
+	bucket = New(session, BucketOptions{
+		DatabaseName: db,
+		BucketName:   "table_config",
+		Shards:       1,
+		Durability:   DurabilityHard,
+	})
+	require.Nil(t, bucket.Init())
+
+	for _, table := range []string{"table_config_files", "table_config_chunks"} {
+		var config tableConfig
+		require.Nil(t, r.DB(db).Table(table).Config().ReadOne(&config, session))
+		assert.Len(t, config.Shards, 1)
+		assert.Len(t, config.Shards[0].Replicas, 1)
+		assert.Equal(t, DurabilityHard, config.Durability)
+	}
+
+	bucket = New(session, BucketOptions{
+		DatabaseName: db,
+		BucketName:   "table_config",
+		Durability:   "fast",
+	})
+	assert.True(t, errors.Is(bucket.Init(), ErrInvalid))
+}
+
+func TestBucketInitPrimaryReplicaTag(t *testing.T) {
+	var reconfigured int
+	bucket := New(session, BucketOptions{
+		DatabaseName:      db,
+		BucketName:        "replica_tag",
+		PrimaryReplicaTag: "default",
+		QueryHooks: []QueryHook{QueryHookFunc(func(ctx context.Context, info QueryInfo, next func(context.Context) error) error {
+			if info.Op == "table_reconfigure" {
+				reconfigured++
+			}
+			return next(ctx)
+		})},
+	})
+	require.Nil(t, bucket.Init())
+	reconfigured = 0
+
+	// The tables are already placed on servers with the tag
+	require.Nil(t, bucket.Init())
+	assert.Equal(t, 0, reconfigured)
+}
+
+func TestTableConfigPlacedOn(t *testing.T) {
+	var config tableConfig
+	config.Shards = append(config.Shards, struct {
+		PrimaryReplica string   `gorethink:"primary_replica"`
+		Replicas       []string `gorethink:"replicas"`
+	}{"a", []string{"a", "b"}})
+
+	assert.True(t, config.placedOn([]string{"a", "b", "c"}))
+	assert.False(t, config.placedOn([]string{"a"}))
+	assert.False(t, config.placedOn([]string{"b"}))
+}
+
 func testBucketInit(t *testing.T, bucket *Bucket) {
 	// Run twice to ensure that all the checks work even if the tables and
 	// indexes already exist
@@ -45,6 +122,9 @@ func testBucketInit(t *testing.T, bucket *Bucket) {
 
 	assert.Contains(t, tables, bucket.bucketName+"_files")
 	assert.Contains(t, tables, bucket.bucketName+"_chunks")
+	assert.Contains(t, tables, bucket.bucketName+"_leases")
+	assert.Contains(t, tables, bucket.bucketName+"_config")
+	assert.Contains(t, tables, bucket.bucketName+"_heads")
 
 	// Assert indexes are created correctly
 	type indexStatus struct {
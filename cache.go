@@ -0,0 +1,205 @@
+package regrid
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// ChunkCache stores the decoded content of chunks keyed by the ID of the file
+// which owns them and the chunk number. Only chunks of complete files are
+// cached, their content never changes so entries are only removed when the
+// file is deleted or the cache evicts them. Implementations must be safe for
+// concurrent use.
+type ChunkCache interface {
+	// Get returns the content of the chunk and whether it was found, the
+	// returned slice must not be modified.
+	Get(fileID string, num int) ([]byte, bool)
+	Put(fileID string, num int, data []byte)
+	// Remove removes all the chunks of the file.
+	Remove(fileID string)
+}
+
+type cacheKey struct {
+	fileID string
+	num    int
+}
+
+type cacheEntry struct {
+	key  cacheKey
+	data []byte
+}
+
+// MemoryCache is a ChunkCache which keeps chunks in memory and evicts the
+// least recently used chunks once the cached content exceeds a byte budget.
+type MemoryCache struct {
+	mu       sync.Mutex
+	maxBytes int
+	size     int
+	lru      *list.List
+	files    map[string]map[int]*list.Element
+}
+
+// NewMemoryCache returns a MemoryCache which holds at most maxBytes bytes of
+// content, chunks larger than maxBytes are not cached.
+func NewMemoryCache(maxBytes int) *MemoryCache {
+	return &MemoryCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		files:    map[string]map[int]*list.Element{},
+	}
+}
+
+func (c *MemoryCache) Get(fileID string, num int) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.files[fileID][num]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+
+	return e.Value.(*cacheEntry).data, true
+}
+
+func (c *MemoryCache) Put(fileID string, num int, data []byte) {
+	if len(data) > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.files[fileID][num]; ok {
+		c.remove(e)
+	}
+
+	chunks := c.files[fileID]
+	if chunks == nil {
+		chunks = map[int]*list.Element{}
+		c.files[fileID] = chunks
+	}
+	chunks[num] = c.lru.PushFront(&cacheEntry{
+		key:  cacheKey{fileID: fileID, num: num},
+		data: data,
+	})
+	c.size += len(data)
+
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *MemoryCache) Remove(fileID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, e := range c.files[fileID] {
+		c.remove(e)
+	}
+}
+
+// Len returns the number of cached chunks and their combined size in bytes.
+func (c *MemoryCache) Len() (chunks, bytes int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len(), c.size
+}
+
+func (c *MemoryCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*cacheEntry)
+	c.size -= len(entry.data)
+
+	chunks := c.files[entry.key.fileID]
+	delete(chunks, entry.key.num)
+	if len(chunks) == 0 {
+		delete(c.files, entry.key.fileID)
+	}
+}
+
+// DiskCache is a ChunkCache which stores each chunk in a file below a
+// directory, so that the cache survives restarts and can be shared by
+// processes on the same host. It does not evict chunks, the directory can be
+// cleared at any time. Each file starts with the CRC-32C of the chunk, chunks
+// which fail the check and failures to read or write the cache are treated
+// as misses.
+type DiskCache struct {
+	dir string
+}
+
+// NewDiskCache returns a DiskCache which stores chunks below dir, creating
+// the directory if it does not exist.
+func NewDiskCache(dir string) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &DiskCache{dir: dir}, nil
+}
+
+func (c *DiskCache) Get(fileID string, num int) ([]byte, bool) {
+	name := filepath.Join(c.fileDir(fileID), strconv.Itoa(num))
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, false
+	}
+
+	if len(data) < crc32.Size || binary.BigEndian.Uint32(data) != crc32.Checksum(data[crc32.Size:], castagnoli) {
+		os.Remove(name)
+		return nil, false
+	}
+
+	return data[crc32.Size:], true
+}
+
+func (c *DiskCache) Put(fileID string, num int, data []byte) {
+	dir := c.fileDir(fileID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+
+	// Write to a temporary file first so that readers never see a partially
+	// written chunk
+	tmp, err := ioutil.TempFile(dir, ".tmp")
+	if err != nil {
+		return
+	}
+	sum := make([]byte, crc32.Size)
+	binary.BigEndian.PutUint32(sum, crc32.Checksum(data, castagnoli))
+	_, err = tmp.Write(append(sum, data...))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(dir, strconv.Itoa(num)))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+}
+
+func (c *DiskCache) Remove(fileID string) {
+	os.RemoveAll(c.fileDir(fileID))
+}
+
+// fileDir returns the directory holding the chunks of the file, file IDs are
+// hashed as they may contain characters which are not valid in paths.
+func (c *DiskCache) fileDir(fileID string) string {
+	sum := sha256.Sum256([]byte(fileID))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+// cacheable reports whether the chunks of the file can be cached. Encrypted
+// files are never cached so that their content is not stored in plain text.
+func (f *File) cacheable() bool {
+	return f.bucket.cache != nil && f.Status == StatusComplete && !f.Inline && f.KeyID == ""
+}
@@ -0,0 +1,182 @@
+package regrid
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryCache(t *testing.T) {
+	c := NewMemoryCache(10)
+	c.Put("a", 0, []byte("1234"))
+	c.Put("a", 1, []byte("5678"))
+
+	// Reading a chunk makes it the most recently used
+	_, ok := c.Get("a", 0)
+	assert.True(t, ok)
+
+	c.Put("b", 0, []byte("abcd"))
+	_, ok = c.Get("a", 1)
+	assert.False(t, ok)
+	data, ok := c.Get("a", 0)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("1234"), data)
+
+	chunks, bytes := c.Len()
+	assert.Equal(t, 2, chunks)
+	assert.Equal(t, 8, bytes)
+
+	// Chunks larger than the budget are not cached
+	c.Put("c", 0, make([]byte, 11))
+	_, ok = c.Get("c", 0)
+	assert.False(t, ok)
+
+	c.Remove("a")
+	_, ok = c.Get("a", 0)
+	assert.False(t, ok)
+	chunks, bytes = c.Len()
+	assert.Equal(t, 1, chunks)
+	assert.Equal(t, 4, bytes)
+}
+
+func TestDiskCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "regrid")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := NewDiskCache(dir)
+	require.Nil(t, err)
+
+	c.Put("/a/../b", 0, []byte("1234"))
+	data, ok := c.Get("/a/../b", 0)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("1234"), data)
+
+	_, ok = c.Get("/a/../b", 1)
+	assert.False(t, ok)
+
+	// A corrupt chunk is a miss
+	c.Put("/a/../b", 1, []byte("5678"))
+	name := filepath.Join(c.fileDir("/a/../b"), "1")
+	stored, err := ioutil.ReadFile(name)
+	require.Nil(t, err)
+	stored[len(stored)-1] ^= 0xff
+	require.Nil(t, ioutil.WriteFile(name, stored, 0600))
+	_, ok = c.Get("/a/../b", 1)
+	assert.False(t, ok)
+
+	c.Remove("/a/../b")
+	_, ok = c.Get("/a/../b", 0)
+	assert.False(t, ok)
+}
+
+func TestBucketCache(t *testing.T) {
+	cache := NewMemoryCache(1 << 20)
+	bucket := New(session, BucketOptions{
+		DatabaseName:   db,
+		BucketName:     "cache",
+		ChunkSizeBytes: 100,
+		Cache:          cache,
+	})
+	require.Nil(t, bucket.Init())
+
+	src, err := ioutil.ReadFile("files/lipsum.txt")
+	require.Nil(t, err)
+
+	dst, err := bucket.Create("/docs/lipsum.txt", nil)
+	require.Nil(t, err)
+	_, err = dst.Write(src)
+	require.Nil(t, err)
+	require.Nil(t, dst.Close())
+
+	file, err := bucket.Open("/docs/lipsum.txt")
+	require.Nil(t, err)
+	data, err := ioutil.ReadAll(file)
+	require.Nil(t, err)
+	require.Nil(t, file.Close())
+	assert.Equal(t, src, data)
+
+	chunks, bytes := cache.Len()
+	assert.Equal(t, 15, chunks)
+	assert.Equal(t, len(src), bytes)
+
+	t.Run("Hit", func(t *testing.T) {
+		// Without the chunks the file can only be read from the cache
+		require.Nil(t, r.DB(db).Table("cache_chunks").Filter(map[string]interface{}{
+			"file_id": dst.ID,
+		}).Delete().Exec(session))
+
+		file, err := bucket.Open("/docs/lipsum.txt")
+		require.Nil(t, err)
+		data, err := ioutil.ReadAll(file)
+		require.Nil(t, err)
+		assert.Equal(t, src, data)
+	})
+
+	t.Run("HardDelete", func(t *testing.T) {
+		require.Nil(t, bucket.HardDelete(dst.ID))
+
+		_, ok := cache.Get(dst.ID, 0)
+		assert.False(t, ok)
+		chunks, _ := cache.Len()
+		assert.Equal(t, 0, chunks)
+	})
+}
+
+func TestBucketCacheReencrypt(t *testing.T) {
+	cache := NewMemoryCache(1 << 20)
+	bucket := New(session, BucketOptions{
+		DatabaseName:   db,
+		BucketName:     "cache_reencrypt",
+		ChunkSizeBytes: 500,
+		Cache:          cache,
+	})
+	require.Nil(t, bucket.Init())
+
+	src, err := ioutil.ReadFile("files/lipsum.txt")
+	require.Nil(t, err)
+
+	dst, err := bucket.Create("/docs/lipsum.txt", nil)
+	require.Nil(t, err)
+	_, err = dst.Write(src)
+	require.Nil(t, err)
+	require.Nil(t, dst.Close())
+
+	file, err := bucket.OpenID(dst.ID)
+	require.Nil(t, err)
+	_, err = ioutil.ReadAll(file)
+	require.Nil(t, err)
+	chunks, _ := cache.Len()
+	require.Equal(t, 3, chunks)
+
+	// The plain text is dropped from the cache once the file is encrypted
+	encrypted := New(session, BucketOptions{
+		DatabaseName:   db,
+		BucketName:     "cache_reencrypt",
+		ChunkSizeBytes: 500,
+		KeyProvider: StaticKeys{
+			CurrentID: "key1",
+			Keys:      map[string][]byte{"key1": bytes.Repeat([]byte{1}, 32)},
+		},
+		Cache: cache,
+	})
+	require.Nil(t, encrypted.SaveConfig())
+	require.Nil(t, encrypted.Reencrypt(dst.ID))
+
+	chunks, _ = cache.Len()
+	assert.Equal(t, 0, chunks)
+
+	file, err = encrypted.OpenID(dst.ID)
+	require.Nil(t, err)
+	data, err := ioutil.ReadAll(file)
+	require.Nil(t, err)
+	assert.Equal(t, src, data)
+	chunks, _ = cache.Len()
+	assert.Equal(t, 0, chunks)
+}
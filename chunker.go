@@ -0,0 +1,107 @@
+package regrid
+
+import "math/bits"
+
+// Chunking is the scheme used to split file content into chunks.
+type Chunking string
+
+const (
+	// ChunkingFixed splits content into chunks of ChunkSize bytes.
+	ChunkingFixed Chunking = ""
+	// ChunkingFastCDC places chunk boundaries based on the content using the
+	// FastCDC rolling hash, so an insert or delete only changes the chunks
+	// around it. ChunkSize is the average chunk size.
+	ChunkingFastCDC Chunking = "fastcdc"
+)
+
+func (c Chunking) valid() bool {
+	return c == ChunkingFixed || c == ChunkingFastCDC
+}
+
+// fastCDC implements normalized content-defined chunking as described in
+// "FastCDC: a Fast and Efficient Content-Defined Chunking Approach for Data
+// Deduplication" (Xia et al., 2016).
+type fastCDC struct {
+	min, avg, max int
+	maskS, maskL  uint64
+}
+
+func newFastCDC(min, avg, max int) (*fastCDC, error) {
+	if min <= 0 || min >= avg || avg >= max {
+		return nil, ErrInvalid
+	}
+
+	// Use a harder mask before the average size and an easier one after it,
+	// this normalizes the chunk size distribution around the average.
+	n := bits.Len(uint(avg)) - 1
+
+	return &fastCDC{
+		min:   min,
+		avg:   avg,
+		max:   max,
+		maskS: highBits(n + 2),
+		maskL: highBits(n - 2),
+	}, nil
+}
+
+// cut returns the length of the next chunk at the start of data. The result
+// only depends on the first max bytes of data.
+func (c *fastCDC) cut(data []byte) int {
+	n := len(data)
+	if n <= c.min {
+		return n
+	}
+	if n > c.max {
+		n = c.max
+	}
+	normal := c.avg
+	if n < normal {
+		normal = n
+	}
+
+	var fp uint64
+	i := c.min
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+
+	return n
+}
+
+// highBits returns a mask with the n most significant bits set, since the
+// fingerprint is shifted left these bits depend on the last 64 bytes read.
+func highBits(n int) uint64 {
+	if n <= 0 {
+		return 0
+	}
+	if n >= 64 {
+		return ^uint64(0)
+	}
+
+	return ^uint64(0) << uint(64-n)
+}
+
+// gearTable maps each byte to a pseudo-random value. It is generated from a
+// fixed seed as chunk boundaries must be stable across processes.
+var gearTable = func() (table [256]uint64) {
+	seed := uint64(0x5265477269640001)
+	for i := range table {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+
+	return
+}()
@@ -0,0 +1,111 @@
+package regrid
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFastCDC(t *testing.T) {
+	data := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	cdc, err := newFastCDC(2048, 8192, 32768)
+	require.Nil(t, err)
+
+	split := func(data []byte) map[[32]byte]bool {
+		chunks := map[[32]byte]bool{}
+		for len(data) > 0 {
+			n := cdc.cut(data)
+			assert.True(t, n <= cdc.max)
+			if n < len(data) {
+				assert.True(t, n >= cdc.min)
+			}
+			chunks[sha256.Sum256(data[:n])] = true
+			data = data[n:]
+		}
+		return chunks
+	}
+
+	original := split(data)
+	edited := split(append([]byte{0}, data...))
+
+	shared := 0
+	for sum := range edited {
+		if original[sum] {
+			shared++
+		}
+	}
+	assert.True(t, shared >= len(original)-2, "%d of %d chunks shared", shared, len(original))
+
+	t.Run("ErrInvalid", func(t *testing.T) {
+		_, err := newFastCDC(8192, 8192, 32768)
+		assert.True(t, errors.Is(err, ErrInvalid))
+	})
+}
+
+func TestBucketCreateFastCDC(t *testing.T) {
+	bucket := New(session, BucketOptions{
+		DatabaseName:   db,
+		BucketName:     "fastcdc",
+		ChunkSizeBytes: 8192,
+		Chunking:       ChunkingFastCDC,
+		DedupeChunks:   true,
+	})
+	require.Nil(t, bucket.Init())
+
+	data := make([]byte, 512*1024)
+	rand.New(rand.NewSource(2)).Read(data)
+
+	upload := func(data []byte, writeSize int) *File {
+		dst, err := bucket.Create("/data/random.bin", nil)
+		require.Nil(t, err)
+		for b := data; len(b) > 0; {
+			n := writeSize
+			if n > len(b) {
+				n = len(b)
+			}
+			_, err = dst.Write(b[:n])
+			require.Nil(t, err)
+			b = b[n:]
+		}
+		require.Nil(t, dst.Close())
+		return dst
+	}
+
+	countBlobs := func() int {
+		cur, err := r.DB(db).Table("fastcdc_blobs").Count().Run(session)
+		require.Nil(t, err)
+		var n int
+		require.Nil(t, cur.One(&n))
+		return n
+	}
+
+	first := upload(data, 1000)
+	blobs := countBlobs()
+
+	file, err := bucket.OpenID(first.ID)
+	require.Nil(t, err)
+	assert.Equal(t, ChunkingFastCDC, file.Chunking)
+	assert.Equal(t, 2048, file.MinChunkSize)
+	assert.Equal(t, 32768, file.MaxChunkSize)
+
+	read, err := ioutil.ReadAll(file)
+	require.Nil(t, err)
+	assert.True(t, bytes.Equal(data, read))
+
+	// The same content written with a different write size is split
+	// identically, and a small edit only adds a couple of new chunks
+	upload(data, 4096)
+	assert.Equal(t, blobs, countBlobs())
+
+	upload(append([]byte("edit"), data...), 4096)
+	assert.True(t, countBlobs() <= blobs+2)
+}
@@ -0,0 +1,87 @@
+package regrid
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Compression is the algorithm used to compress the data of each chunk. The
+// length and hash of a file always describe the uncompressed content.
+type Compression string
+
+const (
+	// CompressionDefault uses the compression configured on the bucket.
+	CompressionDefault Compression = ""
+	CompressionNone    Compression = "none"
+	CompressionGzip    Compression = "gzip"
+	CompressionFlate   Compression = "flate"
+	CompressionZlib    Compression = "zlib"
+)
+
+func (c Compression) valid() bool {
+	switch c {
+	case CompressionDefault, CompressionNone, CompressionGzip, CompressionFlate, CompressionZlib:
+		return true
+	}
+
+	return false
+}
+
+func compressChunk(c Compression, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch c {
+	case CompressionDefault, CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		w = gzip.NewWriter(&buf)
+	case CompressionFlate:
+		var err error
+		if w, err = flate.NewWriter(&buf, flate.DefaultCompression); err != nil {
+			return nil, err
+		}
+	case CompressionZlib:
+		w = zlib.NewWriter(&buf)
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", c)
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decompressChunk(c Compression, data []byte) ([]byte, error) {
+	var rc io.ReadCloser
+	switch c {
+	case CompressionDefault, CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		var err error
+		if rc, err = gzip.NewReader(bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+	case CompressionFlate:
+		rc = flate.NewReader(bytes.NewReader(data))
+	case CompressionZlib:
+		var err error
+		if rc, err = zlib.NewReader(bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", c)
+	}
+	defer rc.Close()
+
+	return ioutil.ReadAll(rc)
+}
@@ -0,0 +1,86 @@
+package regrid
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompression(t *testing.T) {
+	src, err := ioutil.ReadFile("files/lipsum.txt")
+	require.Nil(t, err)
+
+	for _, compression := range []Compression{CompressionGzip, CompressionFlate, CompressionZlib} {
+		t.Run(string(compression), func(t *testing.T) {
+			bucket := New(session, BucketOptions{
+				DatabaseName: db,
+				BucketName:   "compression_" + string(compression),
+				Compression:  compression,
+			})
+			require.Nil(t, bucket.Init())
+
+			dst, err := bucket.Create("/docs/lipsum.txt", nil)
+			require.Nil(t, err)
+			_, err = dst.Write(src)
+			require.Nil(t, err)
+			require.Nil(t, dst.Close())
+
+			file, err := bucket.Open("/docs/lipsum.txt")
+			require.Nil(t, err)
+			assert.Equal(t, compression, file.Compression)
+			assert.Equal(t, 1417, file.Length)
+			assert.Equal(t, "1748f5745c3ef44ba4e1f212069f6e90e29d61bdd320a48c0b06e1255864ed4f", file.Sha256)
+
+			data, err := ioutil.ReadAll(file)
+			require.Nil(t, err)
+			assert.Equal(t, src, data)
+
+			cur, err := r.DB(db).Table(bucket.chunksTable).Filter(map[string]interface{}{
+				"file_id": file.ID,
+			}).Run(session)
+			require.Nil(t, err)
+
+			var chunks []Chunk
+			require.Nil(t, cur.All(&chunks))
+			if assert.Len(t, chunks, 1) {
+				assert.True(t, len(chunks[0].Data) < len(src))
+			}
+		})
+	}
+
+	t.Run("PerFile", func(t *testing.T) {
+		bucket := New(session, BucketOptions{
+			DatabaseName: db,
+			BucketName:   "compression_per_file",
+			Compression:  CompressionGzip,
+		})
+		require.Nil(t, bucket.Init())
+
+		dst, err := bucket.CreateWithOptions("/images/saturnV.jpg", CreateOptions{
+			Compression: CompressionNone,
+		})
+		require.Nil(t, err)
+
+		f, err := os.Open("files/saturnV.jpg")
+		require.Nil(t, err)
+		_, err = io.Copy(dst, f)
+		require.Nil(t, err)
+		require.Nil(t, dst.Close())
+		require.Nil(t, f.Close())
+
+		file, err := bucket.OpenID(dst.ID)
+		require.Nil(t, err)
+		assert.Equal(t, CompressionDefault, file.Compression)
+
+		_, err = bucket.CreateWithOptions("/docs/lipsum.txt", CreateOptions{
+			Compression: "lz4",
+		})
+		assert.True(t, errors.Is(err, ErrInvalid))
+	})
+}
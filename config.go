@@ -0,0 +1,226 @@
+package regrid
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+
+	r "github.com/dancannon/gorethink"
+)
+
+const configID = "config"
+
+// bucketConfig is the configuration stored in the config table by Init, so
+// that every process using the bucket agrees on how files are stored.
+type bucketConfig struct {
+	ID              string          `gorethink:"id"`
+	Version         int             `gorethink:"version"`
+	ChunkSize       int             `gorethink:"chunkSize"`
+	Chunking        Chunking        `gorethink:"chunking"`
+	MinChunkSize    int             `gorethink:"minChunkSize"`
+	MaxChunkSize    int             `gorethink:"maxChunkSize"`
+	Compression     Compression     `gorethink:"compression"`
+	Encryption      bool            `gorethink:"encryption"`
+	DedupeChunks    bool            `gorethink:"dedupeChunks"`
+	DedupeFiles     bool            `gorethink:"dedupeFiles"`
+	InlineThreshold int             `gorethink:"inlineThreshold"`
+	Hashes          []HashAlgorithm `gorethink:"hashes"`
+}
+
+// config returns the configuration described by the bucket's options.
+func (b *Bucket) config() bucketConfig {
+	return bucketConfig{
+		ID:              configID,
+		Version:         layoutVersion(),
+		ChunkSize:       b.chunkSizeBytes,
+		Chunking:        b.chunking,
+		MinChunkSize:    b.minChunkSizeBytes,
+		MaxChunkSize:    b.maxChunkSizeBytes,
+		Compression:     b.compression,
+		Encryption:      b.keyProvider != nil,
+		DedupeChunks:    b.dedupeChunks,
+		DedupeFiles:     b.dedupeFiles,
+		InlineThreshold: b.inlineThresholdBytes,
+		Hashes:          normalizeHashes(b.hashes),
+	}
+}
+
+// equal reports whether the configurations describe the same layout,
+// ignoring the version.
+func (c bucketConfig) equal(other bucketConfig) bool {
+	c.Version, other.Version = 0, 0
+	c.Hashes, other.Hashes = normalizeHashes(c.Hashes), normalizeHashes(other.Hashes)
+
+	return reflect.DeepEqual(c, other)
+}
+
+// normalizeHashes returns the additional hashes sorted and without
+// duplicates, SHA-256 is always calculated so it is left out.
+func normalizeHashes(algorithms []HashAlgorithm) []HashAlgorithm {
+	hashes := []HashAlgorithm{}
+	for _, algorithm := range algorithms {
+		if algorithm != HashSha256 && !containsHash(hashes, algorithm) {
+			hashes = append(hashes, algorithm)
+		}
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return hashes[i] < hashes[j]
+	})
+
+	return hashes
+}
+
+func containsHash(algorithms []HashAlgorithm, algorithm HashAlgorithm) bool {
+	for _, a := range algorithms {
+		if a == algorithm {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SaveConfig replaces the stored configuration of the bucket with the
+// bucket's options. It is used to deliberately change the configuration of
+// an existing bucket, after which Init succeeds for the new options only.
+func (b *Bucket) SaveConfig() error {
+	config := b.config()
+
+	stored, err := b.loadConfig()
+	if err != nil {
+		return wrapError("saveconfig", "", "", err)
+	}
+	if stored != nil {
+		config.Version = stored.Version
+	}
+
+	if err := r.DB(b.databaseName).Table(b.configTable).Get(configID).Replace(
+		config,
+	).Exec(b.exec("save_config", b.configTable, "")); err != nil {
+		return wrapError("saveconfig", "", "", err)
+	}
+	b.configCheck.set()
+
+	return nil
+}
+
+// loadConfig returns the stored configuration or nil if the bucket has none.
+func (b *Bucket) loadConfig() (*bucketConfig, error) {
+	cur, err := r.DB(b.databaseName).Table(b.configTable).Get(configID).Run(b.exec("get_config", b.configTable, ""))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close()
+
+	if cur.IsNil() {
+		return nil, nil
+	}
+
+	var config *bucketConfig
+	if err := cur.One(&config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// setVersion records that the bucket layout has been upgraded to the given
+// version, storing the bucket's configuration if none is stored yet.
+func (b *Bucket) setVersion(version int) error {
+	config := b.config()
+	config.Version = version
+
+	return r.DB(b.databaseName).Table(b.configTable).Get(configID).Replace(func(doc r.Term) interface{} {
+		return r.Branch(
+			doc.Eq(nil),
+			config,
+			doc.Merge(map[string]interface{}{
+				"version": version,
+			}),
+		)
+	}).Exec(b.exec("set_version", b.configTable, ""))
+}
+
+// checkConfig upgrades the bucket layout if it was created by an older
+// version and checks that the stored configuration matches the bucket's
+// options. Buckets without a stored configuration were either just created
+// or predate it, both are upgraded from version 0.
+func (b *Bucket) checkConfig() error {
+	stored, err := b.loadConfig()
+	if err != nil {
+		return err
+	}
+
+	version := 0
+	if stored != nil {
+		version = stored.Version
+	}
+	if version > layoutVersion() {
+		return ErrUnsupportedVersion
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		if err := m.migrate(b); err != nil {
+			return err
+		}
+		if err := b.setVersion(m.version); err != nil {
+			return err
+		}
+	}
+
+	if stored, err = b.loadConfig(); err != nil {
+		return err
+	}
+	if !stored.equal(b.config()) {
+		return ErrConfigMismatch
+	}
+	b.configCheck.set()
+
+	return nil
+}
+
+// configCheck records whether the stored configuration has been checked
+// against the bucket's options, it is shared by copies of the bucket.
+type configCheck struct {
+	mu   sync.Mutex
+	done bool
+}
+
+func (c *configCheck) set() {
+	c.mu.Lock()
+	c.done = true
+	c.mu.Unlock()
+}
+
+// ensureConfig checks the stored configuration against the bucket's options
+// before the first file is read or written, unless Init already has. Unlike
+// Init it does not upgrade the layout, it returns ErrOutdatedLayout for
+// buckets which Init has to upgrade first.
+func (b *Bucket) ensureConfig() error {
+	b.configCheck.mu.Lock()
+	defer b.configCheck.mu.Unlock()
+
+	if b.configCheck.done {
+		return nil
+	}
+
+	stored, err := b.loadConfig()
+	if err != nil {
+		return err
+	}
+	if stored == nil || stored.Version < layoutVersion() {
+		return ErrOutdatedLayout
+	}
+	if stored.Version > layoutVersion() {
+		return ErrUnsupportedVersion
+	}
+	if !stored.equal(b.config()) {
+		return ErrConfigMismatch
+	}
+	b.configCheck.done = true
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package regrid
+
+import (
+	"errors"
+	"testing"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucketConfig(t *testing.T) {
+	options := BucketOptions{
+		DatabaseName:   db,
+		BucketName:     "config",
+		ChunkSizeBytes: 1000,
+		Hashes:         []HashAlgorithm{HashMD5, HashSha1},
+	}
+	bucket := New(session, options)
+	require.Nil(t, bucket.Init())
+
+	t.Run("Stored", func(t *testing.T) {
+		config, err := bucket.loadConfig()
+		require.Nil(t, err)
+		require.NotNil(t, config)
+		assert.Equal(t, layoutVersion(), config.Version)
+		assert.Equal(t, 1000, config.ChunkSize)
+		assert.Equal(t, []HashAlgorithm{HashMD5, HashSha1}, config.Hashes)
+	})
+
+	t.Run("Match", func(t *testing.T) {
+		options := options
+		options.Hashes = []HashAlgorithm{HashSha1, HashMD5, HashSha256}
+		assert.Nil(t, New(session, options).Init())
+	})
+
+	t.Run("CheckedOnUse", func(t *testing.T) {
+		dst, err := bucket.Create("/docs/a.txt", nil)
+		require.Nil(t, err)
+		require.Nil(t, dst.Close())
+
+		// A bucket which was not initialized checks the stored configuration
+		// before the first read or write
+		options := options
+		options.ChunkSizeBytes = 2000
+		other := New(session, options)
+
+		_, err = other.Create("/docs/b.txt", nil)
+		assert.True(t, errors.Is(err, ErrConfigMismatch))
+
+		file, err := other.Open("/docs/a.txt")
+		require.Nil(t, err)
+		_, err = file.Read(make([]byte, 10))
+		assert.True(t, errors.Is(err, ErrConfigMismatch))
+
+		options.ChunkSizeBytes = 1000
+		_, err = New(session, options).Create("/docs/b.txt", nil)
+		assert.Nil(t, err)
+	})
+
+	t.Run("ErrConfigMismatch", func(t *testing.T) {
+		options := options
+		options.ChunkSizeBytes = 2000
+		other := New(session, options)
+		assert.True(t, errors.Is(other.Init(), ErrConfigMismatch))
+
+		require.Nil(t, other.SaveConfig())
+		assert.Nil(t, other.Init())
+		assert.True(t, errors.Is(bucket.Init(), ErrConfigMismatch))
+	})
+
+	t.Run("ErrOutdatedLayout", func(t *testing.T) {
+		require.Nil(t, r.DB(db).Table("config_config").Get(configID).Update(map[string]interface{}{
+			"version": layoutVersion() - 1,
+		}).Exec(session))
+
+		// Only Init upgrades the layout
+		other := New(session, options)
+		_, err := other.Create("/docs/c.txt", nil)
+		assert.True(t, errors.Is(err, ErrOutdatedLayout))
+		_, err = other.Stats()
+		assert.True(t, errors.Is(err, ErrOutdatedLayout))
+
+		require.Nil(t, New(session, options).Init())
+		_, err = other.Create("/docs/c.txt", nil)
+		assert.Nil(t, err)
+	})
+
+	t.Run("ErrUnsupportedVersion", func(t *testing.T) {
+		require.Nil(t, r.DB(db).Table("config_config").Get(configID).Update(map[string]interface{}{
+			"version": layoutVersion() + 1,
+		}).Exec(session))
+		defer r.DB(db).Table("config_config").Get(configID).Update(map[string]interface{}{
+			"version": layoutVersion(),
+		}).Exec(session)
+
+		assert.True(t, errors.Is(bucket.Init(), ErrUnsupportedVersion))
+	})
+}
+
+func TestBucketMigrate(t *testing.T) {
+	bucket := New(session, BucketOptions{
+		DatabaseName: db,
+		BucketName:   "migrate",
+	})
+	require.Nil(t, bucket.Init())
+
+	// Simulate a bucket written before the configuration was stored
+	require.Nil(t, r.DB(db).Table("migrate_config").Delete().Exec(session))
+	require.Nil(t, r.DB(db).Table("migrate_files").Insert(map[string]interface{}{
+		"id":         "old",
+		"filename":   "/docs/old.txt",
+		"status":     StatusComplete,
+		"sha256":     "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		"finishedAt": r.Now(),
+	}).Exec(session))
+
+	require.Nil(t, bucket.Init())
+
+	fi, err := bucket.StatID("old")
+	require.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"sha256": "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+	}, fi.Hashes)
+
+	latest, err := bucket.currentHead("/docs/old.txt")
+	require.Nil(t, err)
+	assert.Equal(t, "old", latest)
+
+	revisions, err := bucket.Revisions("/docs/old.txt")
+	require.Nil(t, err)
+	require.Len(t, revisions, 1)
+	assert.Equal(t, 0, revisions[0].Revision)
+
+	// The next revision is numbered after the migrated ones
+	dst, err := bucket.Create("/docs/old.txt", nil)
+	require.Nil(t, err)
+	require.Nil(t, dst.Close())
+	assert.Equal(t, 1, dst.Revision)
+
+	config, err := bucket.loadConfig()
+	require.Nil(t, err)
+	assert.Equal(t, layoutVersion(), config.Version)
+}
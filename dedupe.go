@@ -0,0 +1,175 @@
+package regrid
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+)
+
+// CollectGarbage recomputes the reference count of blobs from the chunks
+// which point at them and deletes blobs which are no longer referenced. It
+// repairs counts left behind by interrupted uploads or deletes. Only blobs
+// whose count has not changed within the grace period are considered, and a
+// blob is left alone if its count changes while it is being collected, so it
+// is safe to run while files are being written. It returns ErrDedupeDisabled
+// unless the bucket dedupes chunks.
+func (b *Bucket) CollectGarbage(gracePeriod time.Duration) (err error) {
+	defer b.observe("collectgarbage", time.Now(), &err)
+
+	return wrapError("collectgarbage", "", "", b.collectGarbage(gracePeriod))
+}
+
+func (b *Bucket) collectGarbage(gracePeriod time.Duration) error {
+	if !b.dedupeChunks {
+		return ErrDedupeDisabled
+	}
+	if gracePeriod < 0 {
+		return ErrInvalid
+	}
+
+	chunks := r.DB(b.databaseName).Table(b.chunksTable)
+	blobs := r.DB(b.databaseName).Table(b.blobsTable)
+	cutoff := time.Now().Add(-gracePeriod)
+
+	// Chunks are inserted before their blob is referenced, so a count which
+	// misses a new chunk is always followed by a change to updatedAt which
+	// makes the replace leave the blob alone
+	return blobs.Filter(blobUpdatedAt(r.Row).Le(cutoff)).Map(func(blob r.Term) interface{} {
+		return map[string]interface{}{
+			"id":        blob.Field("id"),
+			"updatedAt": blobUpdatedAt(blob),
+			"refs":      chunks.GetAllByIndex(blobIndexName, blob.Field("id")).Count(),
+		}
+	}).ForEach(func(count r.Term) interface{} {
+		return blobs.Get(count.Field("id")).Replace(func(blob r.Term) interface{} {
+			return r.Branch(
+				blob.Eq(nil).Or(blobUpdatedAt(blob).Ne(count.Field("updatedAt"))),
+				blob,
+				count.Field("refs").Le(0),
+				nil,
+				blob.Merge(map[string]interface{}{
+					"refs": count.Field("refs"),
+				}),
+			)
+		})
+	}).Exec(b.exec("collect_blobs", b.blobsTable, ""))
+}
+
+// blobUpdatedAt returns the time the reference count of the blob last
+// changed, blobs stored before the time was recorded count as old.
+func blobUpdatedAt(blob r.Term) r.Term {
+	return blob.Field("updatedAt").Default(r.EpochTime(0))
+}
+
+// findDuplicate returns the earliest complete file, other than the file with
+// the given ID, which has the same content stored in chunks or nil if there is
+// none. Inline files have no chunks to share.
+func (b *Bucket) findDuplicate(id, hash string, length int) (*FileInfo, error) {
+	cursor, err := r.DB(b.databaseName).Table(b.filesTable).GetAllByIndex(
+		hashIndexName, []interface{}{StatusComplete, hash},
+	).Filter(r.And(
+		r.Row.Field("id").Ne(id),
+		r.Row.Field("length").Eq(length),
+		r.Row.Field("inline").Default(false).Not(),
+	)).OrderBy("finishedAt").Limit(1).Run(b.exec("find_duplicate", b.filesTable, id))
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*FileInfo
+	if err := cursor.All(&files); err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, nil
+	}
+
+	return files[0], nil
+}
+
+// chunkFields returns the fields which describe how the chunks of the file
+// are stored, used to point another file at the same chunks.
+func (fi *FileInfo) chunkFields() map[string]interface{} {
+	return map[string]interface{}{
+		"dataId":       fi.chunksID(),
+		"chunkSize":    fi.ChunkSize,
+		"chunking":     fi.Chunking,
+		"minChunkSize": fi.MinChunkSize,
+		"maxChunkSize": fi.MaxChunkSize,
+		"compression":  fi.Compression,
+		"keyId":        fi.KeyID,
+		"dedupe":       fi.Dedupe,
+	}
+}
+
+// storeBlob stores the chunk data keyed by its hash, or increments the
+// reference count if identical data is already stored. It is called after
+// the chunk which references the blob is inserted, so that a failed insert
+// never leaves a reference behind.
+func (b *Bucket) storeBlob(data []byte, d Durability) error {
+	id := blobID(data)
+
+	return r.DB(b.databaseName).Table(b.blobsTable).Get(id).Replace(func(blob r.Term) interface{} {
+		return r.Branch(
+			blob.Eq(nil),
+			map[string]interface{}{
+				"id":        id,
+				"data":      data,
+				"refs":      1,
+				"updatedAt": r.Now(),
+			},
+			blob.Merge(map[string]interface{}{
+				"refs":      blob.Field("refs").Add(1),
+				"updatedAt": r.Now(),
+			}),
+		)
+	}, r.ReplaceOpts{
+		Durability: durability(d),
+	}).Exec(b.exec("store_blob", b.blobsTable, ""))
+}
+
+// blobID returns the ID of the blob which stores the chunk data.
+func blobID(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// releaseBlobs decrements the reference counts of the blobs used by a file's
+// chunks, deleting blobs which are no longer referenced.
+func (b *Bucket) releaseBlobs(fileID string) error {
+	blobs := r.DB(b.databaseName).Table(b.blobsTable)
+
+	return r.DB(b.databaseName).Table(b.chunksTable).Between(
+		[]interface{}{fileID, r.MinVal},
+		[]interface{}{fileID, r.MaxVal},
+	).OptArgs(r.BetweenOpts{
+		Index: chunkIndexName,
+	}).HasFields("blobId").Group("blobId").Count().Ungroup().ForEach(func(group r.Term) interface{} {
+		return blobs.Get(group.Field("group")).Replace(func(blob r.Term) interface{} {
+			return r.Branch(
+				blob.Eq(nil).Or(blob.Field("refs").Le(group.Field("reduction"))),
+				nil,
+				blob.Merge(map[string]interface{}{
+					"refs":      blob.Field("refs").Sub(group.Field("reduction")),
+					"updatedAt": r.Now(),
+				}),
+			)
+		})
+	}).Exec(b.exec("release_blobs", b.blobsTable, fileID))
+}
+
+// joinBlobs replaces the data of chunks which reference a blob with the data
+// of that blob.
+func (b *Bucket) joinBlobs(query r.Term) r.Term {
+	blobs := b.readTable(b.blobsTable)
+
+	return query.Merge(func(chunk r.Term) interface{} {
+		return r.Branch(
+			chunk.HasFields("blobId"),
+			blobs.Get(chunk.Field("blobId")).Pluck("data"),
+			map[string]interface{}{},
+		)
+	})
+}
@@ -0,0 +1,246 @@
+package regrid
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedupeChunks(t *testing.T) {
+	bucket := New(session, BucketOptions{
+		DatabaseName:   db,
+		BucketName:     "dedupe",
+		ChunkSizeBytes: 500,
+		DedupeChunks:   true,
+	})
+	require.Nil(t, bucket.Init())
+
+	src, err := ioutil.ReadFile("files/lipsum.txt")
+	require.Nil(t, err)
+
+	upload := func(filename string) *File {
+		dst, err := bucket.Create(filename, nil)
+		require.Nil(t, err)
+		_, err = dst.Write(src)
+		require.Nil(t, err)
+		require.Nil(t, dst.Close())
+		return dst
+	}
+
+	blobRefs := func() map[string]int {
+		cur, err := r.DB(db).Table("dedupe_blobs").Run(session)
+		require.Nil(t, err)
+
+		var blobs []struct {
+			ID   string `gorethink:"id"`
+			Refs int    `gorethink:"refs"`
+		}
+		require.Nil(t, cur.All(&blobs))
+
+		refs := map[string]int{}
+		for _, blob := range blobs {
+			refs[blob.ID] = blob.Refs
+		}
+		return refs
+	}
+
+	first := upload("/docs/lipsum.txt")
+	second := upload("/docs/copy.txt")
+
+	t.Run("Shared", func(t *testing.T) {
+		refs := blobRefs()
+		assert.Len(t, refs, 3)
+		for _, n := range refs {
+			assert.Equal(t, 2, n)
+		}
+
+		file, err := bucket.OpenID(second.ID)
+		require.Nil(t, err)
+		assert.True(t, file.Dedupe)
+
+		data, err := ioutil.ReadAll(file)
+		require.Nil(t, err)
+		assert.True(t, bytes.Equal(src, data))
+	})
+
+	t.Run("HardDelete", func(t *testing.T) {
+		require.Nil(t, bucket.HardDelete(first.ID))
+		for _, n := range blobRefs() {
+			assert.Equal(t, 1, n)
+		}
+
+		file, err := bucket.OpenID(second.ID)
+		require.Nil(t, err)
+		data, err := ioutil.ReadAll(file)
+		require.Nil(t, err)
+		assert.True(t, bytes.Equal(src, data))
+
+		require.Nil(t, bucket.HardDelete(second.ID))
+		assert.Len(t, blobRefs(), 0)
+	})
+
+	t.Run("CollectGarbage", func(t *testing.T) {
+		dst := upload("/docs/lipsum.txt")
+		require.Nil(t, r.DB(db).Table("dedupe_blobs").Update(map[string]interface{}{
+			"refs": 5,
+		}).Exec(session))
+		require.Nil(t, r.DB(db).Table("dedupe_blobs").Insert(map[string]interface{}{
+			"id":   "orphan",
+			"data": []byte("orphan"),
+			"refs": 1,
+		}).Exec(session))
+
+		// Blobs whose count changed within the grace period are left alone,
+		// the orphan has no updatedAt so it counts as old
+		require.Nil(t, bucket.CollectGarbage(time.Hour))
+		refs := blobRefs()
+		assert.Len(t, refs, 3)
+		for _, n := range refs {
+			assert.Equal(t, 5, n)
+		}
+
+		require.Nil(t, bucket.CollectGarbage(0))
+
+		refs = blobRefs()
+		assert.Len(t, refs, 3)
+		for _, n := range refs {
+			assert.Equal(t, 1, n)
+		}
+
+		require.Nil(t, bucket.HardDelete(dst.ID))
+		assert.Len(t, blobRefs(), 0)
+	})
+
+	t.Run("HardDeleteWithoutOption", func(t *testing.T) {
+		dst := upload("/docs/lipsum.txt")
+		assert.Len(t, blobRefs(), 3)
+
+		// The blobs are released because the file was stored with dedupe
+		plain := New(session, BucketOptions{
+			DatabaseName: db,
+			BucketName:   "dedupe",
+		})
+		require.Nil(t, plain.HardDelete(dst.ID))
+		assert.Len(t, blobRefs(), 0)
+		assert.True(t, errors.Is(plain.CollectGarbage(0), ErrDedupeDisabled))
+	})
+
+	t.Run("ErrInvalid", func(t *testing.T) {
+		bucket := New(session, BucketOptions{
+			DatabaseName: db,
+			BucketName:   "dedupe",
+			DedupeChunks: true,
+			KeyProvider:  StaticKeys{},
+		})
+		assert.True(t, errors.Is(bucket.Init(), ErrInvalid))
+	})
+}
+
+func TestDedupeFiles(t *testing.T) {
+	bucket := New(session, BucketOptions{
+		DatabaseName:   db,
+		BucketName:     "dedupe_files",
+		ChunkSizeBytes: 500,
+		DedupeFiles:    true,
+	})
+	require.Nil(t, bucket.Init())
+
+	src, err := ioutil.ReadFile("files/lipsum.txt")
+	require.Nil(t, err)
+
+	upload := func(filename string) *File {
+		dst, err := bucket.Create(filename, nil)
+		require.Nil(t, err)
+		_, err = dst.Write(src)
+		require.Nil(t, err)
+		require.Nil(t, dst.Close())
+		return dst
+	}
+
+	countChunks := func(id string) int {
+		cur, err := r.DB(db).Table("dedupe_files_chunks").Filter(map[string]interface{}{
+			"file_id": id,
+		}).Count().Run(session)
+		require.Nil(t, err)
+		var n int
+		require.Nil(t, cur.One(&n))
+		return n
+	}
+
+	first := upload("/docs/lipsum.txt")
+	second := upload("/docs/copy.txt")
+
+	t.Run("FindBySha256", func(t *testing.T) {
+		files, err := bucket.FindBySha256("1748F5745C3EF44BA4E1F212069F6E90E29D61BDD320A48C0B06E1255864ED4F")
+		require.Nil(t, err)
+		if assert.Len(t, files, 2) {
+			assert.Equal(t, first.ID, files[0].ID)
+			assert.Equal(t, second.ID, files[1].ID)
+		}
+
+		files, err = bucket.FindBySha256("e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+		require.Nil(t, err)
+		assert.Len(t, files, 0)
+	})
+
+	t.Run("Shared", func(t *testing.T) {
+		assert.Equal(t, 3, countChunks(first.ID))
+		assert.Equal(t, 0, countChunks(second.ID))
+
+		file, err := bucket.OpenID(second.ID)
+		require.Nil(t, err)
+		assert.Equal(t, first.ID, file.DataID)
+
+		data, err := ioutil.ReadAll(file)
+		require.Nil(t, err)
+		assert.True(t, bytes.Equal(src, data))
+	})
+
+	t.Run("HardDelete", func(t *testing.T) {
+		require.Nil(t, bucket.HardDelete(first.ID))
+		assert.Equal(t, 3, countChunks(first.ID))
+
+		file, err := bucket.OpenID(second.ID)
+		require.Nil(t, err)
+		data, err := ioutil.ReadAll(file)
+		require.Nil(t, err)
+		assert.True(t, bytes.Equal(src, data))
+
+		require.Nil(t, bucket.HardDelete(second.ID))
+		assert.Equal(t, 0, countChunks(first.ID))
+	})
+
+	t.Run("InlineDuplicate", func(t *testing.T) {
+		// Another process may store files inline, which cannot be set up
+		// through this bucket as its configuration differs
+		require.Nil(t, r.DB(db).Table("dedupe_files_files").Insert(map[string]interface{}{
+			"id":         "inline",
+			"filename":   "/docs/inline.txt",
+			"status":     StatusComplete,
+			"length":     len(src),
+			"inline":     true,
+			"data":       src,
+			"sha256":     "1748f5745c3ef44ba4e1f212069f6e90e29d61bdd320a48c0b06e1255864ed4f",
+			"finishedAt": r.Now(),
+			"startedAt":  r.Now(),
+		}).Exec(session))
+
+		// An inline file has no chunks so the upload keeps its own
+		chunked := upload("/docs/chunked.txt")
+		assert.Equal(t, 3, countChunks(chunked.ID))
+
+		file, err := bucket.OpenID(chunked.ID)
+		require.Nil(t, err)
+		assert.Equal(t, "", file.DataID)
+
+		data, err := ioutil.ReadAll(file)
+		require.Nil(t, err)
+		assert.True(t, bytes.Equal(src, data))
+	})
+}
@@ -0,0 +1,299 @@
+package regrid
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"strconv"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+)
+
+// KeyProvider supplies the keys used to encrypt chunk data with AES-GCM. Keys
+// must be 16, 24 or 32 bytes long.
+type KeyProvider interface {
+	// CurrentKey returns the ID and value of the key used to encrypt new data.
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key with the given ID.
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider backed by a fixed set of keys.
+type StaticKeys struct {
+	CurrentID string
+	Keys      map[string][]byte
+}
+
+func (k StaticKeys) CurrentKey() (string, []byte, error) {
+	key, err := k.Key(k.CurrentID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return k.CurrentID, key, nil
+}
+
+func (k StaticKeys) Key(id string) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+
+	return key, nil
+}
+
+// ReencryptAll re-encrypts every complete file which is not encrypted with
+// the current key of the bucket's KeyProvider.
+func (b *Bucket) ReencryptAll() (err error) {
+	defer b.observe("reencrypt", time.Now(), &err)
+
+	return wrapError("reencrypt", "", "", b.reencryptAll())
+}
+
+func (b *Bucket) reencryptAll() error {
+	if b.keyProvider == nil {
+		return ErrNoKeyProvider
+	}
+
+	keyID, _, err := b.keyProvider.CurrentKey()
+	if err != nil {
+		return err
+	}
+
+	cur, err := r.DB(b.databaseName).Table(b.filesTable).Filter(r.And(
+		r.Row.Field("status").Eq(StatusComplete),
+		r.Row.Field("keyId").Default("").Ne(keyID).Or(r.Row.Field("encrypting").Default(false)),
+	)).Field("id").Run(b.exec("list_reencrypt", b.filesTable, ""))
+	if err != nil {
+		return err
+	}
+
+	var ids []string
+	if err := cur.All(&ids); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := b.reencrypt(id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Reencrypt re-encrypts the chunks of a file with the current key of the
+// bucket's KeyProvider. Files which are not encrypted are encrypted, inline
+// files are moved into an encrypted chunk. The key ID is stored on each chunk
+// so an interrupted re-encryption can be resumed, files stored in plain text
+// are marked as encrypting until every chunk is encrypted.
+func (b *Bucket) Reencrypt(id string) (err error) {
+	defer b.observe("reencrypt", time.Now(), &err)
+
+	return wrapError("reencrypt", "", id, b.reencrypt(id))
+}
+
+func (b *Bucket) reencrypt(id string) error {
+	if b.keyProvider == nil {
+		return ErrNoKeyProvider
+	}
+
+	file, err := b.openID(id)
+	if err != nil {
+		return err
+	}
+
+	keyID, _, err := b.keyProvider.CurrentKey()
+	if err != nil {
+		return err
+	}
+	if file.Inline {
+		return b.encryptInline(file, keyID)
+	}
+
+	// Mark the file as encrypted before any chunk is, chunks which are still
+	// in plain text are only accepted while the file is encrypting
+	if file.KeyID == "" {
+		if err := r.DB(b.databaseName).Table(b.filesTable).Get(id).Update(map[string]interface{}{
+			"keyId":      keyID,
+			"encrypting": true,
+		}).Exec(b.exec("update_file", b.filesTable, id)); err != nil {
+			return err
+		}
+		file.KeyID = keyID
+		file.Encrypting = true
+	}
+	// Only plain text files are cached, drop their content now that they are
+	// encrypted
+	if b.cache != nil {
+		b.cache.Remove(file.chunksID())
+	}
+
+	cur, err := r.DB(b.databaseName).Table(b.chunksTable).Between(
+		[]interface{}{file.chunksID(), r.MinVal},
+		[]interface{}{file.chunksID(), r.MaxVal},
+	).OptArgs(r.BetweenOpts{
+		Index: chunkIndexName,
+	}).Filter(r.Row.Field("keyId").Default("").Ne(keyID)).Run(b.exec("get_chunks", b.chunksTable, id))
+	if err != nil {
+		return err
+	}
+	defer cur.Close()
+
+	for {
+		var chunk *Chunk
+		if !cur.Next(&chunk) {
+			break
+		}
+
+		if err := chunk.verify(file.ID); err != nil {
+			b.metrics.HashMismatch()
+			return err
+		}
+		data, err := file.decryptChunk(chunk)
+		if err != nil {
+			return err
+		}
+		data, nonce, err := file.encryptChunk(keyID, chunk.Num, data)
+		if err != nil {
+			return err
+		}
+
+		if err := r.DB(b.databaseName).Table(b.chunksTable).Get(chunk.ID).Update(map[string]interface{}{
+			"data":     data,
+			"nonce":    nonce,
+			"keyId":    keyID,
+			"checksum": chunkChecksum(data),
+		}).Exec(b.execChunk("reencrypt_chunk", id, chunk.Num)); err != nil {
+			return err
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+
+	return r.DB(b.databaseName).Table(b.filesTable).Get(id).Update(map[string]interface{}{
+		"keyId":      keyID,
+		"encrypting": false,
+	}).Exec(b.exec("update_file", b.filesTable, id))
+}
+
+// encryptInline moves the content of an inline file into a single encrypted
+// chunk, as encrypted files are never stored inline. The chunk is written
+// before the file stops being inline so that an interrupted run leaves the
+// file readable and can be repeated.
+func (b *Bucket) encryptInline(file *File, keyID string) error {
+	data := file.InlineData
+	if data == nil && file.Length > 0 {
+		if err := r.DB(b.databaseName).Table(b.filesTable).Get(file.ID).Field("data").ReadOne(&data, b.exec("get_inline_data", b.filesTable, file.ID)); err != nil {
+			return err
+		}
+	}
+
+	if len(data) > 0 {
+		compressed, err := compressChunk(file.Compression, data)
+		if err != nil {
+			return err
+		}
+		chunk := Chunk{
+			ID:     chunkID(file.ID, 0),
+			FileID: file.ID,
+			KeyID:  keyID,
+		}
+		if chunk.Data, chunk.Nonce, err = file.encryptChunk(keyID, 0, compressed); err != nil {
+			return err
+		}
+		chunk.Checksum = chunkChecksum(chunk.Data)
+
+		if err := r.DB(b.databaseName).Table(b.chunksTable).Insert(chunk, r.InsertOpts{
+			Conflict: "replace",
+		}).Exec(b.execChunk("insert_chunk", file.ID, 0)); err != nil {
+			return err
+		}
+	}
+
+	return r.DB(b.databaseName).Table(b.filesTable).Get(file.ID).Update(map[string]interface{}{
+		"inline":     false,
+		"data":       r.Literal(),
+		"keyId":      keyID,
+		"encrypting": false,
+	}).Exec(b.exec("update_file", b.filesTable, file.ID))
+}
+
+func (f *File) aead(keyID string) (cipher.AEAD, error) {
+	if f.bucket.keyProvider == nil {
+		return nil, ErrNoKeyProvider
+	}
+	if aead, ok := f.aeads[keyID]; ok {
+		return aead, nil
+	}
+
+	key, err := f.bucket.keyProvider.Key(keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.aeads == nil {
+		f.aeads = map[string]cipher.AEAD{}
+	}
+	f.aeads[keyID] = aead
+
+	return aead, nil
+}
+
+func (f *File) encryptChunk(keyID string, num int, data []byte) ([]byte, []byte, error) {
+	aead, err := f.aead(keyID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+
+	return aead.Seal(nil, nonce, data, chunkAdditionalData(f.chunksID(), num)), nonce, nil
+}
+
+// decryptChunk authenticates and decrypts the chunk data. Chunks without a key
+// ID are only accepted from files which are not encrypted, or which are being
+// encrypted by Reencrypt.
+func (f *File) decryptChunk(chunk *Chunk) ([]byte, error) {
+	if chunk.KeyID == "" {
+		if f.KeyID != "" && !f.Encrypting {
+			return nil, ErrDecryptionFailed
+		}
+		return chunk.Data, nil
+	}
+
+	aead, err := f.aead(chunk.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunk.Nonce) != aead.NonceSize() {
+		return nil, ErrDecryptionFailed
+	}
+
+	data, err := aead.Open(nil, chunk.Nonce, chunk.Data, chunkAdditionalData(f.chunksID(), chunk.Num))
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+
+	return data, nil
+}
+
+// chunkAdditionalData binds the ciphertext to its position so that chunks
+// cannot be reordered or moved between files without detection.
+func chunkAdditionalData(fileID string, num int) []byte {
+	return []byte(fileID + ":" + strconv.Itoa(num))
+}
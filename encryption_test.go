@@ -0,0 +1,236 @@
+package regrid
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryption(t *testing.T) {
+	keys := StaticKeys{
+		CurrentID: "key1",
+		Keys: map[string][]byte{
+			"key1": bytes.Repeat([]byte{1}, 32),
+			"key2": bytes.Repeat([]byte{2}, 32),
+		},
+	}
+	bucket := New(session, BucketOptions{
+		DatabaseName:   db,
+		BucketName:     "encryption",
+		ChunkSizeBytes: 500,
+		KeyProvider:    keys,
+	})
+	require.Nil(t, bucket.Init())
+
+	src, err := ioutil.ReadFile("files/lipsum.txt")
+	require.Nil(t, err)
+
+	readChunks := func(id string) []Chunk {
+		cur, err := r.DB(db).Table("encryption_chunks").Filter(map[string]interface{}{
+			"file_id": id,
+		}).OrderBy("num").Run(session)
+		require.Nil(t, err)
+
+		var chunks []Chunk
+		require.Nil(t, cur.All(&chunks))
+		return chunks
+	}
+
+	dst, err := bucket.Create("/docs/lipsum.txt", nil)
+	require.Nil(t, err)
+	_, err = dst.Write(src)
+	require.Nil(t, err)
+	require.Nil(t, dst.Close())
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		file, err := bucket.OpenID(dst.ID)
+		require.Nil(t, err)
+		assert.Equal(t, "key1", file.KeyID)
+
+		data, err := ioutil.ReadAll(file)
+		require.Nil(t, err)
+		assert.Equal(t, src, data)
+
+		chunks := readChunks(dst.ID)
+		if assert.Len(t, chunks, 3) {
+			for _, chunk := range chunks {
+				assert.Equal(t, "key1", chunk.KeyID)
+				assert.Len(t, chunk.Nonce, 12)
+				assert.False(t, bytes.Contains(src, chunk.Data[:16]))
+			}
+		}
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		chunks := readChunks(dst.ID)
+		require.Len(t, chunks, 3)
+
+		data := append([]byte{}, chunks[1].Data...)
+		data[0] ^= 0xff
+		require.Nil(t, r.DB(db).Table("encryption_chunks").Get(chunks[1].ID).Update(map[string]interface{}{
+			"data":     data,
+			"checksum": chunkChecksum(data),
+		}).Exec(session))
+
+		file, err := bucket.OpenID(dst.ID)
+		require.Nil(t, err)
+		_, err = ioutil.ReadAll(file)
+		assert.True(t, errors.Is(err, ErrDecryptionFailed))
+
+		require.Nil(t, r.DB(db).Table("encryption_chunks").Get(chunks[1].ID).Update(map[string]interface{}{
+			"data":     chunks[1].Data,
+			"checksum": chunks[1].Checksum,
+		}).Exec(session))
+	})
+
+	t.Run("PlainChunk", func(t *testing.T) {
+		chunks := readChunks(dst.ID)
+		require.Len(t, chunks, 3)
+
+		// A chunk swapped for plain text with a valid checksum is rejected
+		// because the file is encrypted
+		plain := src[500:1000]
+		require.Nil(t, r.DB(db).Table("encryption_chunks").Get(chunks[1].ID).Replace(r.Row.Without("keyId", "nonce").Merge(map[string]interface{}{
+			"data":     plain,
+			"checksum": chunkChecksum(plain),
+		})).Exec(session))
+
+		file, err := bucket.OpenID(dst.ID)
+		require.Nil(t, err)
+		_, err = ioutil.ReadAll(file)
+		assert.True(t, errors.Is(err, ErrDecryptionFailed))
+
+		require.Nil(t, r.DB(db).Table("encryption_chunks").Get(chunks[1].ID).Replace(chunks[1]).Exec(session))
+	})
+
+	t.Run("Reencrypt", func(t *testing.T) {
+		keys.CurrentID = "key2"
+		rotated := New(session, BucketOptions{
+			DatabaseName:   db,
+			BucketName:     "encryption",
+			ChunkSizeBytes: 500,
+			KeyProvider:    keys,
+		})
+		require.Nil(t, rotated.ReencryptAll())
+
+		file, err := rotated.OpenID(dst.ID)
+		require.Nil(t, err)
+		assert.Equal(t, "key2", file.KeyID)
+
+		for _, chunk := range readChunks(dst.ID) {
+			assert.Equal(t, "key2", chunk.KeyID)
+		}
+
+		data, err := ioutil.ReadAll(file)
+		require.Nil(t, err)
+		assert.Equal(t, src, data)
+	})
+
+	t.Run("EncryptPlaintext", func(t *testing.T) {
+		plain := New(session, BucketOptions{
+			DatabaseName:   db,
+			BucketName:     "encryption_plain",
+			ChunkSizeBytes: 500,
+		})
+		require.Nil(t, plain.Init())
+
+		dst, err := plain.Create("/docs/plain.txt", nil)
+		require.Nil(t, err)
+		_, err = dst.Write(src)
+		require.Nil(t, err)
+		require.Nil(t, dst.Close())
+
+		// Enabling encryption changes the configuration of the bucket
+		encrypted := New(session, BucketOptions{
+			DatabaseName:   db,
+			BucketName:     "encryption_plain",
+			ChunkSizeBytes: 500,
+			KeyProvider:    keys,
+		})
+		require.Nil(t, encrypted.SaveConfig())
+		require.Nil(t, encrypted.Reencrypt(dst.ID))
+
+		file, err := encrypted.OpenID(dst.ID)
+		require.Nil(t, err)
+		assert.Equal(t, keys.CurrentID, file.KeyID)
+		assert.False(t, file.Encrypting)
+
+		data, err := ioutil.ReadAll(file)
+		require.Nil(t, err)
+		assert.Equal(t, src, data)
+	})
+
+	t.Run("EncryptInline", func(t *testing.T) {
+		plain := New(session, BucketOptions{
+			DatabaseName:         db,
+			BucketName:           "encryption_inline",
+			ChunkSizeBytes:       500,
+			InlineThresholdBytes: 1024,
+		})
+		require.Nil(t, plain.Init())
+
+		small := []byte(`{"name": "config", "enabled": true}`)
+		dst, err := plain.Create("/config.json", nil)
+		require.Nil(t, err)
+		_, err = dst.Write(small)
+		require.Nil(t, err)
+		require.Nil(t, dst.Close())
+
+		encrypted := New(session, BucketOptions{
+			DatabaseName:         db,
+			BucketName:           "encryption_inline",
+			ChunkSizeBytes:       500,
+			InlineThresholdBytes: 1024,
+			KeyProvider:          keys,
+		})
+		require.Nil(t, encrypted.SaveConfig())
+		require.Nil(t, encrypted.Reencrypt(dst.ID))
+
+		// The content is moved out of the files document into an encrypted
+		// chunk
+		cur, err := r.DB(db).Table("encryption_inline_files").Get(dst.ID).Run(session)
+		require.Nil(t, err)
+		var doc map[string]interface{}
+		require.Nil(t, cur.One(&doc))
+		assert.NotContains(t, doc, "data")
+
+		cur, err = r.DB(db).Table("encryption_inline_chunks").Filter(map[string]interface{}{
+			"file_id": dst.ID,
+		}).Run(session)
+		require.Nil(t, err)
+		var chunks []Chunk
+		require.Nil(t, cur.All(&chunks))
+		require.Len(t, chunks, 1)
+		assert.Equal(t, keys.CurrentID, chunks[0].KeyID)
+		assert.False(t, bytes.Contains(chunks[0].Data, small))
+
+		file, err := encrypted.OpenID(dst.ID)
+		require.Nil(t, err)
+		assert.False(t, file.Inline)
+		assert.Equal(t, keys.CurrentID, file.KeyID)
+
+		data, err := ioutil.ReadAll(file)
+		require.Nil(t, err)
+		assert.Equal(t, small, data)
+	})
+
+	t.Run("ErrNoKeyProvider", func(t *testing.T) {
+		plain := New(session, BucketOptions{
+			DatabaseName:   db,
+			BucketName:     "encryption",
+			ChunkSizeBytes: 500,
+		})
+		assert.True(t, errors.Is(plain.ReencryptAll(), ErrNoKeyProvider))
+
+		// The stored configuration requires encryption
+		file, err := plain.OpenID(dst.ID)
+		require.Nil(t, err)
+		_, err = ioutil.ReadAll(file)
+		assert.True(t, errors.Is(err, ErrConfigMismatch))
+	})
+}
@@ -0,0 +1,88 @@
+package regrid
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Error records an error and the operation and file which caused it.
+type Error struct {
+	Op       string
+	Filename string
+	ID       string
+	// Revision is set for operations on a specific revision of a file.
+	Revision *int
+	Err      error
+}
+
+func (e *Error) Error() string {
+	s := "regrid: " + e.Op
+	if e.Filename != "" {
+		s += " " + e.Filename
+	}
+
+	var details []string
+	if e.ID != "" {
+		details = append(details, "id "+e.ID)
+	}
+	if e.Revision != nil {
+		details = append(details, "revision "+strconv.Itoa(*e.Revision))
+	}
+	if len(details) > 0 {
+		s += " (" + strings.Join(details, ", ") + ")"
+	}
+
+	return s + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ChunkError records an error reading a specific chunk of a file.
+type ChunkError struct {
+	FileID string
+	Num    int
+	Err    error
+}
+
+func (e *ChunkError) Error() string {
+	return "chunk " + strconv.Itoa(e.Num) + " of file " + e.FileID + ": " + e.Err.Error()
+}
+
+func (e *ChunkError) Unwrap() error {
+	return e.Err
+}
+
+// wrapError adds the operation and file to err, errors which already have
+// this context are returned unchanged.
+func wrapError(op, filename, id string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+	if isTableNotExist(err) {
+		err = ErrNotInitialized
+	}
+
+	return &Error{Op: op, Filename: filename, ID: id, Err: err}
+}
+
+func wrapRevisionError(op, filename string, revision int, err error) error {
+	err = wrapError(op, filename, "", err)
+	if e, ok := err.(*Error); ok && e.Revision == nil {
+		e.Revision = &revision
+	}
+
+	return err
+}
+
+// isTableNotExist reports whether err is the RethinkDB error returned when
+// querying a table which has not been created, usually because Init has not
+// been called for the bucket.
+func isTableNotExist(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "Table `") && strings.Contains(msg, "` does not exist")
+}
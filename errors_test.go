@@ -0,0 +1,48 @@
+package regrid
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestError(t *testing.T) {
+	bucket := New(session, BucketOptions{
+		DatabaseName: db,
+		BucketName:   "errors",
+	})
+
+	t.Run("ErrNotInitialized", func(t *testing.T) {
+		_, err := bucket.Open("/docs/lipsum.txt")
+		assert.True(t, errors.Is(err, ErrNotInitialized))
+		assert.Equal(t, "regrid: open /docs/lipsum.txt: bucket not initialized", err.Error())
+	})
+
+	require.Nil(t, bucket.Init())
+
+	t.Run("Open", func(t *testing.T) {
+		_, err := bucket.Open("/docs/lipsum.txt")
+		assert.True(t, errors.Is(err, ErrNotExist))
+
+		var e *Error
+		if assert.True(t, errors.As(err, &e)) {
+			assert.Equal(t, "open", e.Op)
+			assert.Equal(t, "/docs/lipsum.txt", e.Filename)
+			assert.Nil(t, e.Revision)
+		}
+	})
+
+	t.Run("OpenRevision", func(t *testing.T) {
+		_, err := bucket.OpenRevision("/docs/lipsum.txt", 2)
+		assert.True(t, errors.Is(err, ErrNotExist))
+		assert.Equal(t, "regrid: open /docs/lipsum.txt (revision 2): file does not exist", err.Error())
+	})
+
+	t.Run("HardDelete", func(t *testing.T) {
+		err := bucket.HardDelete("notfound")
+		assert.True(t, errors.Is(err, ErrNotExist))
+		assert.Equal(t, "regrid: harddelete (id notfound): file does not exist", err.Error())
+	})
+}
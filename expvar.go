@@ -0,0 +1,70 @@
+package regrid
+
+import (
+	"expvar"
+	"time"
+)
+
+// ExpvarMetrics publishes the metrics of a bucket with the expvar package.
+type ExpvarMetrics struct {
+	// Operations, Errors and Nanoseconds are keyed by operation, Nanoseconds
+	// is the total latency.
+	Operations  *expvar.Map
+	Errors      *expvar.Map
+	Nanoseconds *expvar.Map
+
+	BytesRead      *expvar.Int
+	BytesWritten   *expvar.Int
+	ChunksRead     *expvar.Int
+	ChunksWritten  *expvar.Int
+	HashMismatches *expvar.Int
+}
+
+// NewExpvarMetrics publishes the metrics as a map with the given name, like
+// expvar.NewMap it panics if the name is already in use.
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	m := &ExpvarMetrics{
+		Operations:     new(expvar.Map).Init(),
+		Errors:         new(expvar.Map).Init(),
+		Nanoseconds:    new(expvar.Map).Init(),
+		BytesRead:      new(expvar.Int),
+		BytesWritten:   new(expvar.Int),
+		ChunksRead:     new(expvar.Int),
+		ChunksWritten:  new(expvar.Int),
+		HashMismatches: new(expvar.Int),
+	}
+
+	vars := expvar.NewMap(name)
+	vars.Set("operations", m.Operations)
+	vars.Set("errors", m.Errors)
+	vars.Set("nanoseconds", m.Nanoseconds)
+	vars.Set("bytes_read", m.BytesRead)
+	vars.Set("bytes_written", m.BytesWritten)
+	vars.Set("chunks_read", m.ChunksRead)
+	vars.Set("chunks_written", m.ChunksWritten)
+	vars.Set("hash_mismatches", m.HashMismatches)
+
+	return m
+}
+
+func (m *ExpvarMetrics) ObserveOperation(op string, latency time.Duration, err error) {
+	m.Operations.Add(op, 1)
+	if err != nil {
+		m.Errors.Add(op, 1)
+	}
+	m.Nanoseconds.Add(op, int64(latency))
+}
+
+func (m *ExpvarMetrics) AddRead(bytes, chunks int) {
+	m.BytesRead.Add(int64(bytes))
+	m.ChunksRead.Add(int64(chunks))
+}
+
+func (m *ExpvarMetrics) AddWritten(bytes, chunks int) {
+	m.BytesWritten.Add(int64(bytes))
+	m.ChunksWritten.Add(int64(chunks))
+}
+
+func (m *ExpvarMetrics) HashMismatch() {
+	m.HashMismatches.Add(1)
+}
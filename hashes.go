@@ -0,0 +1,115 @@
+package regrid
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"sync"
+)
+
+// HashAlgorithm names a hash which can be calculated over file content, the
+// hex encoded sum is stored in the hashes field of the files document.
+type HashAlgorithm string
+
+const (
+	HashSha256 HashAlgorithm = "sha256"
+	HashSha1   HashAlgorithm = "sha1"
+	HashSha512 HashAlgorithm = "sha512"
+	HashMD5    HashAlgorithm = "md5"
+	HashCRC32C HashAlgorithm = "crc32c"
+)
+
+var (
+	hashesMu sync.RWMutex
+	hashes   = map[HashAlgorithm]func() hash.Hash{
+		HashSha256: sha256.New,
+		HashSha1:   sha1.New,
+		HashSha512: sha512.New,
+		HashMD5:    md5.New,
+		HashCRC32C: func() hash.Hash {
+			return crc32.New(castagnoli)
+		},
+	}
+)
+
+// RegisterHash makes a hash algorithm available to BucketOptions.Hashes and
+// BucketOptions.VerifyHashes, replacing any algorithm with the same name.
+func RegisterHash(name HashAlgorithm, newHash func() hash.Hash) {
+	hashesMu.Lock()
+	defer hashesMu.Unlock()
+
+	hashes[name] = newHash
+}
+
+func newHash(name HashAlgorithm) (hash.Hash, error) {
+	hashesMu.RLock()
+	defer hashesMu.RUnlock()
+
+	newHash, ok := hashes[name]
+	if !ok {
+		return nil, ErrInvalid
+	}
+
+	return newHash(), nil
+}
+
+// resetHashes prepares the SHA-256 hash, which is always calculated as it is
+// part of the ReGrid spec, and any additional hashes.
+func (f *File) resetHashes(algorithms []HashAlgorithm) error {
+	f.hash = sha256.New()
+	f.hashes = map[HashAlgorithm]hash.Hash{}
+	for _, algorithm := range algorithms {
+		if algorithm == HashSha256 {
+			continue
+		}
+
+		h, err := newHash(algorithm)
+		if err != nil {
+			return err
+		}
+		f.hashes[algorithm] = h
+	}
+
+	return nil
+}
+
+func (f *File) writeHashes(b []byte) {
+	f.hash.Write(b)
+	for _, h := range f.hashes {
+		h.Write(b)
+	}
+}
+
+func (f *File) sumHashes() map[string]string {
+	sums := map[string]string{
+		string(HashSha256): hex.EncodeToString(f.hash.Sum(nil)),
+	}
+	for algorithm, h := range f.hashes {
+		sums[string(algorithm)] = hex.EncodeToString(h.Sum(nil))
+	}
+
+	return sums
+}
+
+// verifyHashes compares the calculated hashes with the hashes stored when the
+// file was written. Apart from SHA-256, hashes which were not stored when the
+// file was written are skipped.
+func (f *File) verifyHashes(algorithms []HashAlgorithm) error {
+	sums := f.sumHashes()
+	for _, algorithm := range algorithms {
+		expected, ok := f.Hashes[string(algorithm)]
+		if algorithm == HashSha256 {
+			expected, ok = f.Sha256, true
+		}
+		if ok && expected != sums[string(algorithm)] {
+			f.bucket.metrics.HashMismatch()
+			return ErrHashMismatch
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package regrid
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"hash/fnv"
+	"io/ioutil"
+	"testing"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashes(t *testing.T) {
+	RegisterHash("fnv64", func() hash.Hash {
+		return fnv.New64()
+	})
+
+	bucket := New(session, BucketOptions{
+		DatabaseName: db,
+		BucketName:   "hashes",
+		Hashes:       []HashAlgorithm{HashMD5, HashCRC32C, "fnv64"},
+		VerifyHashes: []HashAlgorithm{HashMD5},
+	})
+	require.Nil(t, bucket.Init())
+
+	src, err := ioutil.ReadFile("files/lipsum.txt")
+	require.Nil(t, err)
+
+	dst, err := bucket.Create("/docs/lipsum.txt", nil)
+	require.Nil(t, err)
+	_, err = dst.Write(src)
+	require.Nil(t, err)
+	require.Nil(t, dst.Close())
+
+	t.Run("Stored", func(t *testing.T) {
+		file, err := bucket.OpenID(dst.ID)
+		require.Nil(t, err)
+
+		md5Sum := md5.Sum(src)
+		crc := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+		crc.Write(src)
+		fnvHash := fnv.New64()
+		fnvHash.Write(src)
+
+		assert.Equal(t, "1748f5745c3ef44ba4e1f212069f6e90e29d61bdd320a48c0b06e1255864ed4f", file.Sha256)
+		assert.Equal(t, map[string]string{
+			"sha256": "1748f5745c3ef44ba4e1f212069f6e90e29d61bdd320a48c0b06e1255864ed4f",
+			"md5":    hex.EncodeToString(md5Sum[:]),
+			"crc32c": hex.EncodeToString(crc.Sum(nil)),
+			"fnv64":  hex.EncodeToString(fnvHash.Sum(nil)),
+		}, file.Hashes)
+	})
+
+	t.Run("Verify", func(t *testing.T) {
+		// Only the hashes listed in VerifyHashes are checked
+		require.Nil(t, r.DB(db).Table("hashes_files").Get(dst.ID).Update(map[string]interface{}{
+			"sha256": "invalid",
+		}).Exec(session))
+
+		file, err := bucket.OpenID(dst.ID)
+		require.Nil(t, err)
+		_, err = ioutil.ReadAll(file)
+		assert.Nil(t, err)
+
+		require.Nil(t, r.DB(db).Table("hashes_files").Get(dst.ID).Update(map[string]interface{}{
+			"hashes": map[string]interface{}{"md5": "invalid"},
+		}).Exec(session))
+
+		file, err = bucket.OpenID(dst.ID)
+		require.Nil(t, err)
+		_, err = ioutil.ReadAll(file)
+		assert.True(t, errors.Is(err, ErrHashMismatch))
+	})
+
+	t.Run("ErrInvalid", func(t *testing.T) {
+		bucket := New(session, BucketOptions{
+			DatabaseName: db,
+			BucketName:   "hashes",
+			Hashes:       []HashAlgorithm{"unknown"},
+		})
+
+		_, err := bucket.Create("/docs/lipsum.txt", nil)
+		assert.True(t, errors.Is(err, ErrInvalid))
+	})
+}
@@ -0,0 +1,237 @@
+package regrid
+
+import (
+	"fmt"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/dancannon/gorethink/encoding"
+)
+
+// The heads table holds one document per filename recording the ID of its
+// latest complete revision and how many revision numbers have been assigned.
+// Completing a file advances the head with a single document compare-and-swap,
+// which RethinkDB applies atomically, so that conditional uploads of the same
+// filename cannot both succeed and every revision gets a distinct number.
+
+// headLatest builds a ReQL expression which evaluates to the ID of the latest
+// revision of the filename or nil if there is none.
+func (b *Bucket) headLatest(filename string) r.Term {
+	return r.DB(b.databaseName).Table(b.headsTable).Get(filename).Field("latest").Default(nil)
+}
+
+// head is the document in the heads table for a filename.
+type head struct {
+	Filename  string      `gorethink:"id"`
+	Latest    interface{} `gorethink:"latest"`
+	Revisions int         `gorethink:"revisions"`
+}
+
+// advanceHead makes the file the latest revision of its filename if the
+// precondition holds for the current head, and returns the revision number
+// assigned to the file. Advancing the head to a file it already points at
+// returns the same number, so that completing a file can be retried.
+func (b *Bucket) advanceHead(f *File) (int, error) {
+	rsp, err := r.DB(b.databaseName).Table(b.headsTable).Get(f.Filename).Replace(func(old r.Term) interface{} {
+		latest := old.Field("latest").Default(nil)
+
+		return r.Branch(
+			latest.Eq(f.ID),
+			old,
+			f.precondition.revisionTerm(latest),
+			map[string]interface{}{
+				"id":        f.Filename,
+				"latest":    f.ID,
+				"revisions": old.Field("revisions").Default(0).Add(1),
+			},
+			r.Error(preconditionFailedMessage),
+		)
+	}, r.ReplaceOpts{
+		Durability:    durability(f.durability),
+		ReturnChanges: "always",
+	}).RunWrite(b.exec("advance_head", b.headsTable, f.ID))
+	if err != nil {
+		if rsp.FirstError == preconditionFailedMessage {
+			return 0, ErrPreconditionFailed
+		}
+		return 0, err
+	}
+
+	return decodeRevision(rsp)
+}
+
+// assignRevision takes the next revision number of the filename for a file
+// renamed to it. Numbers taken by renames which then fail are skipped.
+func (b *Bucket) assignRevision(filename string) (int, error) {
+	rsp, err := r.DB(b.databaseName).Table(b.headsTable).Get(filename).Replace(func(old r.Term) interface{} {
+		return r.Branch(
+			old.Eq(nil),
+			map[string]interface{}{
+				"id":        filename,
+				"latest":    nil,
+				"revisions": 1,
+			},
+			old.Merge(map[string]interface{}{
+				"revisions": old.Field("revisions").Default(0).Add(1),
+			}),
+		)
+	}, r.ReplaceOpts{
+		ReturnChanges: "always",
+	}).RunWrite(b.exec("assign_revision", b.headsTable, ""))
+	if err != nil {
+		return 0, err
+	}
+
+	return decodeRevision(rsp)
+}
+
+// decodeRevision returns the number of the revision most recently assigned
+// by a write to a head.
+func decodeRevision(rsp r.WriteResponse) (int, error) {
+	if len(rsp.Changes) != 1 {
+		return 0, fmt.Errorf("head not returned by write")
+	}
+
+	var h head
+	if err := encoding.Decode(&h, rsp.Changes[0].NewValue); err != nil {
+		return 0, err
+	}
+
+	return h.Revisions - 1, nil
+}
+
+// refreshHead points the head of the filename at its latest complete
+// revision after revisions were deleted or renamed, unless the head no longer
+// points at expected because another file has since completed.
+func (b *Bucket) refreshHead(filename string, expected interface{}) error {
+	var id interface{}
+	if err := b.latestRevisionID(filename).ReadOne(&id, b.exec("get_file", b.filesTable, "")); err != nil && err != r.ErrEmptyResult {
+		return err
+	}
+
+	return r.DB(b.databaseName).Table(b.headsTable).Get(filename).Replace(func(old r.Term) interface{} {
+		return r.Branch(
+			old.Field("latest").Default(nil).Eq(expected),
+			map[string]interface{}{
+				"id":        filename,
+				"latest":    id,
+				"revisions": old.Field("revisions").Default(0),
+			},
+			old,
+		)
+	}).Exec(b.exec("refresh_head", b.headsTable, ""))
+}
+
+// currentHead returns the ID of the latest revision recorded by the head of
+// the filename, or nil if there is none.
+func (b *Bucket) currentHead(filename string) (interface{}, error) {
+	var latest interface{}
+	if err := b.headLatest(filename).ReadOne(&latest, b.exec("get_head", b.headsTable, "")); err != nil && err != r.ErrEmptyResult {
+		return nil, err
+	}
+
+	return latest, nil
+}
+
+// migrateHeads creates the heads of filenames written before the heads table
+// existed, heads which already exist are left alone.
+func (b *Bucket) migrateHeads() error {
+	var heads []map[string]interface{}
+	insert := func() error {
+		if len(heads) == 0 {
+			return nil
+		}
+		// Conflicting heads are errors which Exec ignores
+		err := r.DB(b.databaseName).Table(b.headsTable).Insert(heads).Exec(b.exec("insert_heads", b.headsTable, ""))
+		heads = heads[:0]
+		return err
+	}
+
+	if err := b.eachFilename(func(filename string, ids []string) error {
+		heads = append(heads, map[string]interface{}{
+			"id":     filename,
+			"latest": ids[len(ids)-1],
+		})
+		if len(heads) < 200 {
+			return nil
+		}
+		return insert()
+	}); err != nil {
+		return err
+	}
+
+	return insert()
+}
+
+// migrateRevisions numbers the complete revisions of each filename in the
+// order they completed and records the count on the head of the filename.
+func (b *Bucket) migrateRevisions() error {
+	files := r.DB(b.databaseName).Table(b.filesTable)
+
+	return b.eachFilename(func(filename string, ids []string) error {
+		revisions := make([]map[string]interface{}, len(ids))
+		for i, id := range ids {
+			revisions[i] = map[string]interface{}{"id": id, "revision": i}
+		}
+		if err := r.Expr(revisions).ForEach(func(revision r.Term) interface{} {
+			return files.Get(revision.Field("id")).Update(map[string]interface{}{
+				"revision": revision.Field("revision"),
+			})
+		}).Exec(b.exec("migrate_revisions", b.filesTable, "")); err != nil {
+			return err
+		}
+
+		return r.DB(b.databaseName).Table(b.headsTable).Get(filename).Replace(func(old r.Term) interface{} {
+			return r.Branch(
+				old.Eq(nil),
+				map[string]interface{}{
+					"id":        filename,
+					"latest":    ids[len(ids)-1],
+					"revisions": len(ids),
+				},
+				old.Merge(map[string]interface{}{
+					"revisions": len(ids),
+				}),
+			)
+		}).Exec(b.exec("migrate_revisions", b.headsTable, ""))
+	})
+}
+
+// eachFilename calls fn with the IDs of the complete revisions of each
+// filename, oldest first.
+func (b *Bucket) eachFilename(fn func(filename string, ids []string) error) error {
+	cur, err := r.DB(b.databaseName).Table(b.filesTable).Between(
+		[]interface{}{StatusComplete, r.MinVal, r.MinVal},
+		[]interface{}{StatusComplete, r.MaxVal, r.MaxVal},
+	).OptArgs(r.BetweenOpts{
+		Index: fileIndexName,
+	}).OrderBy(r.OrderByOpts{
+		Index: fileIndexName,
+	}).Pluck("id", "filename").Run(b.exec("list_files", b.filesTable, ""))
+	if err != nil {
+		return err
+	}
+	defer cur.Close()
+
+	// Revisions are ordered by filename and then finishedAt
+	var (
+		filename string
+		ids      []string
+	)
+	for {
+		var fi *FileInfo
+		more := cur.Next(&fi)
+		if len(ids) > 0 && (!more || fi.Filename != filename) {
+			if err := fn(filename, ids); err != nil {
+				return err
+			}
+			ids = nil
+		}
+		if !more {
+			break
+		}
+		filename = fi.Filename
+		ids = append(ids, fi.ID)
+	}
+
+	return cur.Err()
+}
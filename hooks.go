@@ -0,0 +1,106 @@
+package regrid
+
+import (
+	"context"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+)
+
+// QueryInfo describes a query issued by a bucket or file.
+type QueryInfo struct {
+	// Op names the query, for example "insert_chunk" or "get_file".
+	Op    string
+	Table string
+	// FileID is the ID of the file the query is for, if any.
+	FileID string
+	// Chunk is the number of the chunk the query is for, or -1.
+	Chunk int
+}
+
+// QueryHook is invoked around every query issued by a bucket and the files
+// it opens. It must call next to run the query and return its error, hooks
+// configured on a bucket are nested with the first outermost. For queries
+// returning a cursor only the initial request is run inside the hook.
+type QueryHook interface {
+	Query(ctx context.Context, info QueryInfo, next func(context.Context) error) error
+}
+
+// QueryHookFunc adapts a function to a QueryHook.
+type QueryHookFunc func(ctx context.Context, info QueryInfo, next func(context.Context) error) error
+
+func (fn QueryHookFunc) Query(ctx context.Context, info QueryInfo, next func(context.Context) error) error {
+	return fn(ctx, info, next)
+}
+
+// hookedSession runs queries on the embedded session inside the hooks.
+type hookedSession struct {
+	*r.Session
+	hooks []QueryHook
+	info  QueryInfo
+}
+
+func (s *hookedSession) Query(ctx context.Context, q r.Query) (cursor *r.Cursor, err error) {
+	err = s.run(ctx, 0, func(ctx context.Context) error {
+		cursor, err = s.Session.Query(ctx, q)
+		return err
+	})
+
+	return cursor, err
+}
+
+func (s *hookedSession) Exec(ctx context.Context, q r.Query) error {
+	return s.run(ctx, 0, func(ctx context.Context) error {
+		return s.Session.Exec(ctx, q)
+	})
+}
+
+func (s *hookedSession) run(ctx context.Context, i int, query func(context.Context) error) error {
+	if i == len(s.hooks) {
+		return query(ctx)
+	}
+
+	return s.hooks[i].Query(ctx, s.info, func(ctx context.Context) error {
+		return s.run(ctx, i+1, query)
+	})
+}
+
+// exec returns the executor for a query which is not for a single chunk.
+func (b *Bucket) exec(op, table, fileID string) r.QueryExecutor {
+	return b.executor(QueryInfo{
+		Op:     op,
+		Table:  table,
+		FileID: fileID,
+		Chunk:  -1,
+	})
+}
+
+// execChunk returns the executor for a query for a single chunk.
+func (b *Bucket) execChunk(op, fileID string, num int) r.QueryExecutor {
+	return b.executor(QueryInfo{
+		Op:     op,
+		Table:  b.chunksTable,
+		FileID: fileID,
+		Chunk:  num,
+	})
+}
+
+func (b *Bucket) executor(info QueryInfo) r.QueryExecutor {
+	if len(b.queryHooks) == 0 {
+		return b.session
+	}
+
+	return &hookedSession{
+		Session: b.session,
+		hooks:   b.queryHooks,
+		info:    info,
+	}
+}
+
+// timeQuery runs next and returns how long it took.
+func timeQuery(ctx context.Context, next func(context.Context) error) (time.Duration, error) {
+	start := time.Now()
+	err := next(ctx)
+
+	return time.Since(start), err
+}
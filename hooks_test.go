@@ -0,0 +1,102 @@
+package regrid
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryHooks(t *testing.T) {
+	var order []string
+	hook := func(name string) QueryHook {
+		return QueryHookFunc(func(ctx context.Context, info QueryInfo, next func(context.Context) error) error {
+			order = append(order, name+":"+info.Op)
+			return next(ctx)
+		})
+	}
+
+	var logs bytes.Buffer
+	recorder := &SpanRecorder{}
+	bucket := New(session, BucketOptions{
+		DatabaseName:   db,
+		BucketName:     "hooks",
+		ChunkSizeBytes: 500,
+		QueryHooks: []QueryHook{
+			hook("outer"),
+			hook("inner"),
+			SlogHook(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))),
+			TracingHook(recorder),
+		},
+	})
+	require.Nil(t, bucket.Init())
+	recorder.Reset()
+	logs.Reset()
+	order = nil
+
+	dst, err := bucket.Create("/docs/lipsum.txt", nil)
+	require.Nil(t, err)
+	_, err = dst.Write(bytes.Repeat([]byte("a"), 1000))
+	require.Nil(t, err)
+	require.Nil(t, dst.Close())
+
+	t.Run("Order", func(t *testing.T) {
+		assert.Equal(t, []string{
+			"outer:insert_file", "inner:insert_file",
+			"outer:insert_chunk", "inner:insert_chunk",
+			"outer:insert_chunk", "inner:insert_chunk",
+			"outer:complete_file", "inner:complete_file",
+		}, order)
+	})
+
+	t.Run("Tracing", func(t *testing.T) {
+		spans := recorder.Spans()
+		require.Len(t, spans, 4)
+
+		span := spans[2]
+		assert.Equal(t, "regrid.insert_chunk", span.Name)
+		assert.Equal(t, "hooks_chunks", span.Attributes["db.sql.table"])
+		assert.Equal(t, dst.ID, span.Attributes["regrid.file_id"])
+		assert.Equal(t, 1, span.Attributes["regrid.chunk"])
+		assert.Nil(t, span.Err)
+		assert.False(t, span.EndTime.Before(span.StartTime))
+
+		_, ok := spans[0].Attributes["regrid.chunk"]
+		assert.False(t, ok)
+	})
+
+	t.Run("Slog", func(t *testing.T) {
+		lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+		require.Len(t, lines, 4)
+		assert.Contains(t, lines[1], "op=insert_chunk")
+		assert.Contains(t, lines[1], "table=hooks_chunks")
+		assert.Contains(t, lines[1], "chunk=0")
+		assert.Contains(t, lines[1], "duration=")
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		recorder.Reset()
+		logs.Reset()
+
+		uninitialized := New(session, BucketOptions{
+			DatabaseName: db,
+			BucketName:   "hooks_uninitialized",
+			QueryHooks: []QueryHook{
+				SlogHook(slog.New(slog.NewTextHandler(&logs, nil))),
+				TracingHook(recorder),
+			},
+		})
+		_, err := uninitialized.Stat("/docs/lipsum.txt")
+		assert.True(t, errors.Is(err, ErrNotInitialized))
+
+		spans := recorder.Spans()
+		require.Len(t, spans, 1)
+		assert.NotNil(t, spans[0].Err)
+		assert.Contains(t, logs.String(), "level=ERROR")
+	})
+}
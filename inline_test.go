@@ -0,0 +1,106 @@
+package regrid
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInline(t *testing.T) {
+	bucket := New(session, BucketOptions{
+		DatabaseName:         db,
+		BucketName:           "inline",
+		ChunkSizeBytes:       500,
+		InlineThresholdBytes: 1024,
+	})
+	require.Nil(t, bucket.Init())
+
+	countChunks := func(id string) int {
+		cur, err := r.DB(db).Table("inline_chunks").Filter(map[string]interface{}{
+			"file_id": id,
+		}).Count().Run(session)
+		require.Nil(t, err)
+		var n int
+		require.Nil(t, cur.One(&n))
+		return n
+	}
+
+	upload := func(filename string, data []byte, writeSize int) *File {
+		dst, err := bucket.Create(filename, nil)
+		require.Nil(t, err)
+		for b := data; len(b) > 0; {
+			n := writeSize
+			if n > len(b) {
+				n = len(b)
+			}
+			_, err = dst.Write(b[:n])
+			require.Nil(t, err)
+			b = b[n:]
+		}
+		require.Nil(t, dst.Close())
+		return dst
+	}
+
+	small := []byte(`{"name": "config", "enabled": true}`)
+	large, err := ioutil.ReadFile("files/lipsum.txt")
+	require.Nil(t, err)
+
+	t.Run("Small", func(t *testing.T) {
+		dst := upload("/config.json", small, 10)
+		assert.Equal(t, 0, countChunks(dst.ID))
+
+		file, err := bucket.Open("/config.json")
+		require.Nil(t, err)
+		assert.True(t, file.Inline)
+		assert.Equal(t, len(small), file.Length)
+
+		data, err := ioutil.ReadAll(file)
+		require.Nil(t, err)
+		assert.True(t, bytes.Equal(small, data))
+		assert.Nil(t, file.Close())
+	})
+
+	t.Run("Large", func(t *testing.T) {
+		dst := upload("/docs/lipsum.txt", large, 100)
+		assert.Equal(t, 15, countChunks(dst.ID))
+
+		file, err := bucket.Open("/docs/lipsum.txt")
+		require.Nil(t, err)
+		assert.False(t, file.Inline)
+
+		data, err := ioutil.ReadAll(file)
+		require.Nil(t, err)
+		assert.True(t, bytes.Equal(large, data))
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		upload("/empty.txt", nil, 1)
+
+		file, err := bucket.Open("/empty.txt")
+		require.Nil(t, err)
+		assert.True(t, file.Inline)
+
+		data, err := ioutil.ReadAll(file)
+		require.Nil(t, err)
+		assert.Len(t, data, 0)
+	})
+
+	t.Run("List", func(t *testing.T) {
+		files, err := bucket.ListFilename("/config.json", 0, 0, false)
+		require.Nil(t, err)
+		require.Len(t, files, 1)
+		assert.True(t, files[0].Inline)
+		assert.Nil(t, files[0].InlineData)
+
+		file, err := files[0].Open()
+		require.Nil(t, err)
+
+		data, err := ioutil.ReadAll(file)
+		require.Nil(t, err)
+		assert.True(t, bytes.Equal(small, data))
+	})
+}
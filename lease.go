@@ -0,0 +1,244 @@
+package regrid
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/dancannon/gorethink/encoding"
+)
+
+const (
+	leaseNotHeldMessage  = "regrid: lease not held"
+	otherFilenameMessage = "regrid: file does not have the leased filename"
+)
+
+// Lease grants exclusive access to a filename until it expires. Leases are
+// advisory, they are only enforced by operations which are given the lease
+// such as CreateWithOptions, Lease.Rename and Lease.Delete.
+type Lease struct {
+	bucket *Bucket
+
+	Filename  string    `gorethink:"id"`
+	Token     string    `gorethink:"token"`
+	ExpiresAt time.Time `gorethink:"expiresAt"`
+}
+
+// AcquireLease acquires a lease on the filename which expires after ttl. If
+// the filename is leased by someone else then ErrLeaseHeld is returned, unless
+// that lease has expired in which case it is taken over.
+func (b *Bucket) AcquireLease(filename string, ttl time.Duration) (_ *Lease, err error) {
+	defer b.observe("acquirelease", time.Now(), &err)
+
+	lease, err := b.acquireLease(filename, ttl)
+	if err != nil {
+		return nil, wrapError("acquirelease", filename, "", err)
+	}
+
+	return lease, nil
+}
+
+func (b *Bucket) acquireLease(filename string, ttl time.Duration) (*Lease, error) {
+	if ttl <= 0 {
+		return nil, ErrInvalid
+	}
+
+	token, err := newLeaseToken()
+	if err != nil {
+		return nil, err
+	}
+
+	rsp, err := r.DB(b.databaseName).Table(b.leasesTable).Get(filename).Replace(func(old r.Term) r.Term {
+		return r.Branch(
+			old.Eq(nil).Or(old.Field("expiresAt").Le(r.Now())),
+			map[string]interface{}{
+				"id":        filename,
+				"token":     token,
+				"expiresAt": r.Now().Add(ttl.Seconds()),
+			},
+			old,
+		)
+	}, r.ReplaceOpts{
+		ReturnChanges: true,
+	}).RunWrite(b.exec("acquire_lease", b.leasesTable, ""))
+	if err != nil {
+		return nil, err
+	}
+
+	if rsp.Inserted == 0 && rsp.Replaced == 0 {
+		return nil, ErrLeaseHeld
+	}
+
+	lease := &Lease{bucket: b}
+	if err := encoding.Decode(lease, rsp.Changes[0].NewValue); err != nil {
+		return nil, err
+	}
+
+	return lease, nil
+}
+
+// Renew extends the lease so that it expires ttl from now. ErrLeaseNotHeld is
+// returned if the lease has expired or has been taken over.
+func (l *Lease) Renew(ttl time.Duration) (err error) {
+	defer l.bucket.observe("renewlease", time.Now(), &err)
+
+	return wrapError("renewlease", l.Filename, "", l.renew(ttl))
+}
+
+func (l *Lease) renew(ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalid
+	}
+
+	rsp, err := l.table().Get(l.Filename).Update(func(old r.Term) r.Term {
+		return r.Branch(
+			l.heldBy(old),
+			map[string]interface{}{
+				"expiresAt": r.Now().Add(ttl.Seconds()),
+			},
+			map[string]interface{}{},
+		)
+	}, r.UpdateOpts{
+		ReturnChanges: true,
+	}).RunWrite(l.bucket.exec("renew_lease", l.bucket.leasesTable, ""))
+	if err != nil {
+		return err
+	}
+
+	if rsp.Replaced == 0 {
+		return ErrLeaseNotHeld
+	}
+
+	var lease Lease
+	if err := encoding.Decode(&lease, rsp.Changes[0].NewValue); err != nil {
+		return err
+	}
+	l.ExpiresAt = lease.ExpiresAt
+
+	return nil
+}
+
+// Release gives up the lease. ErrLeaseNotHeld is returned if the lease has
+// already been taken over by someone else.
+func (l *Lease) Release() (err error) {
+	defer l.bucket.observe("releaselease", time.Now(), &err)
+
+	return wrapError("releaselease", l.Filename, "", l.release())
+}
+
+func (l *Lease) release() error {
+	rsp, err := l.table().Get(l.Filename).Replace(func(old r.Term) r.Term {
+		return r.Branch(old.Field("token").Default(nil).Eq(l.Token), nil, old)
+	}).RunWrite(l.bucket.exec("release_lease", l.bucket.leasesTable, ""))
+	if err != nil {
+		return err
+	}
+
+	if rsp.Deleted == 0 {
+		return ErrLeaseNotHeld
+	}
+
+	return nil
+}
+
+// Create creates a new revision of the leased filename, see CreateWithOptions.
+func (l *Lease) Create(metadata map[string]interface{}) (*File, error) {
+	return l.bucket.CreateWithOptions(l.Filename, CreateOptions{
+		Metadata: metadata,
+		Lease:    l,
+	})
+}
+
+// Rename renames the file with the given ID, which must currently have the
+// leased filename.
+func (l *Lease) Rename(id, filename string) (err error) {
+	defer l.bucket.observe("rename", time.Now(), &err)
+
+	return wrapError("rename", l.Filename, id, l.rename(id, filename))
+}
+
+func (l *Lease) rename(id, filename string) error {
+	head, err := l.bucket.currentHead(filename)
+	if err != nil {
+		return err
+	}
+	revision, err := l.bucket.assignRevision(filename)
+	if err != nil {
+		return err
+	}
+	if err := l.guardedUpdate(id, map[string]interface{}{
+		"filename": filename,
+		"revision": revision,
+	}); err != nil {
+		return err
+	}
+
+	return l.bucket.refreshHead(filename, head)
+}
+
+// Delete marks the file with the given ID, which must currently have the
+// leased filename, as deleted.
+func (l *Lease) Delete(id string) (err error) {
+	defer l.bucket.observe("delete", time.Now(), &err)
+
+	return wrapError("delete", l.Filename, id, l.guardedUpdate(id, map[string]interface{}{
+		"status": StatusDeleted,
+	}))
+}
+
+// guardedUpdate updates the file if the lease is held and the file has the
+// leased filename, and then refreshes the head of the leased filename. It
+// returns ErrInvalid if the file has another filename and ErrLeaseNotHeld if
+// the lease is no longer held.
+func (l *Lease) guardedUpdate(id string, update map[string]interface{}) error {
+	rsp, err := r.DB(l.bucket.databaseName).Table(l.bucket.filesTable).Get(id).Update(func(file r.Term) r.Term {
+		return r.Branch(
+			file.Field("filename").Ne(l.Filename),
+			r.Error(otherFilenameMessage),
+			l.heldTerm(),
+			update,
+			r.Error(leaseNotHeldMessage),
+		)
+	}, r.UpdateOpts{
+		NonAtomic: true,
+	}).RunWrite(l.bucket.exec("update_file", l.bucket.filesTable, id))
+	if err != nil {
+		switch rsp.FirstError {
+		case leaseNotHeldMessage:
+			return ErrLeaseNotHeld
+		case otherFilenameMessage:
+			return ErrInvalid
+		}
+		return err
+	}
+
+	if rsp.Replaced == 0 && rsp.Unchanged == 0 {
+		return ErrNotExist
+	}
+
+	return l.bucket.refreshHead(l.Filename, id)
+}
+
+func (l *Lease) table() r.Term {
+	return r.DB(l.bucket.databaseName).Table(l.bucket.leasesTable)
+}
+
+// heldTerm builds a ReQL expression which evaluates to true if the lease is
+// still held.
+func (l *Lease) heldTerm() r.Term {
+	return l.heldBy(l.table().Get(l.Filename))
+}
+
+func (l *Lease) heldBy(lease r.Term) r.Term {
+	return lease.Field("token").Eq(l.Token).And(lease.Field("expiresAt").Gt(r.Now())).Default(false)
+}
+
+func newLeaseToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,121 @@
+package regrid
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLease(t *testing.T) {
+	bucket := New(session, BucketOptions{
+		DatabaseName: db,
+		BucketName:   "lease",
+	})
+	require.Nil(t, bucket.Init())
+
+	t.Run("AcquireRelease", func(t *testing.T) {
+		lease, err := bucket.AcquireLease("/docs/lipsum.txt", time.Minute)
+		require.Nil(t, err)
+		assert.Equal(t, "/docs/lipsum.txt", lease.Filename)
+		assert.NotEmpty(t, lease.Token)
+
+		_, err = bucket.AcquireLease("/docs/lipsum.txt", time.Minute)
+		assert.True(t, errors.Is(err, ErrLeaseHeld))
+
+		require.Nil(t, lease.Release())
+		assert.True(t, errors.Is(lease.Release(), ErrLeaseNotHeld))
+
+		lease, err = bucket.AcquireLease("/docs/lipsum.txt", time.Minute)
+		require.Nil(t, err)
+		require.Nil(t, lease.Release())
+	})
+
+	t.Run("Renew", func(t *testing.T) {
+		lease, err := bucket.AcquireLease("/docs/renew.txt", time.Second)
+		require.Nil(t, err)
+
+		expiresAt := lease.ExpiresAt
+		require.Nil(t, lease.Renew(time.Minute))
+		assert.True(t, lease.ExpiresAt.After(expiresAt))
+
+		time.Sleep(1500 * time.Millisecond)
+		_, err = bucket.AcquireLease("/docs/renew.txt", time.Minute)
+		assert.True(t, errors.Is(err, ErrLeaseHeld))
+
+		require.Nil(t, lease.Release())
+	})
+
+	t.Run("StealOnExpiry", func(t *testing.T) {
+		lease, err := bucket.AcquireLease("/docs/steal.txt", 500*time.Millisecond)
+		require.Nil(t, err)
+
+		time.Sleep(time.Second)
+
+		stolen, err := bucket.AcquireLease("/docs/steal.txt", time.Minute)
+		require.Nil(t, err)
+		assert.NotEqual(t, lease.Token, stolen.Token)
+
+		assert.True(t, errors.Is(lease.Renew(time.Minute), ErrLeaseNotHeld))
+		assert.True(t, errors.Is(lease.Release(), ErrLeaseNotHeld))
+		require.Nil(t, stolen.Release())
+	})
+
+	t.Run("GuardCreate", func(t *testing.T) {
+		lease, err := bucket.AcquireLease("/images/saturnV.jpg", time.Minute)
+		require.Nil(t, err)
+
+		dst, err := lease.Create(nil)
+		require.Nil(t, err)
+
+		src, err := os.Open("files/saturnV.jpg")
+		require.Nil(t, err)
+
+		_, err = io.Copy(dst, src)
+		require.Nil(t, err)
+		require.Nil(t, src.Close())
+
+		require.Nil(t, lease.Release())
+		assert.True(t, errors.Is(dst.Close(), ErrLeaseNotHeld))
+
+		_, err = bucket.OpenID(dst.ID)
+		assert.True(t, errors.Is(err, ErrNotExist))
+
+		_, err = lease.Create(nil)
+		assert.True(t, errors.Is(err, ErrLeaseNotHeld))
+	})
+
+	t.Run("GuardRenameDelete", func(t *testing.T) {
+		dst, err := bucket.Create("/docs/guarded.txt", nil)
+		require.Nil(t, err)
+		require.Nil(t, dst.Close())
+
+		other, err := bucket.AcquireLease("/docs/other.txt", time.Minute)
+		require.Nil(t, err)
+		assert.True(t, errors.Is(other.Rename(dst.ID, "/docs/renamed.txt"), ErrInvalid))
+		assert.True(t, errors.Is(other.Delete(dst.ID), ErrInvalid))
+		require.Nil(t, other.Release())
+		assert.True(t, errors.Is(other.Delete(dst.ID), ErrInvalid))
+
+		// A released lease no longer guards files with its filename
+		released, err := bucket.AcquireLease("/docs/guarded.txt", time.Minute)
+		require.Nil(t, err)
+		require.Nil(t, released.Release())
+		assert.True(t, errors.Is(released.Delete(dst.ID), ErrLeaseNotHeld))
+
+		lease, err := bucket.AcquireLease("/docs/guarded.txt", time.Minute)
+		require.Nil(t, err)
+		require.Nil(t, lease.Rename(dst.ID, "/docs/renamed.txt"))
+		assert.True(t, errors.Is(lease.Delete(dst.ID), ErrInvalid))
+		assert.True(t, errors.Is(lease.Delete("notfound"), ErrNotExist))
+		require.Nil(t, lease.Release())
+
+		file, err := bucket.OpenID(dst.ID)
+		require.Nil(t, err)
+		assert.Equal(t, "/docs/renamed.txt", file.Filename)
+	})
+}
@@ -1,22 +1,25 @@
 package regrid
 
-import r "github.com/dancannon/gorethink"
+import (
+	"strings"
+	"time"
 
-func (b *Bucket) ListRegex(pattern string, skip, limit int, reverse bool) ([]*FileInfo, error) {
-	query := r.DB(b.databaseName).Table(b.filesTable).Between(
-		[]interface{}{StatusComplete, r.MinVal},
-		[]interface{}{StatusComplete, r.MaxVal},
-	).OptArgs(r.BetweenOpts{
-		Index: fileIndexName,
-	})
+	r "github.com/dancannon/gorethink"
+)
 
-	if reverse {
-		query = query.OrderBy(r.OrderByOpts{Index: r.Desc(fileIndexName)})
-	} else {
-		query = query.OrderBy(r.OrderByOpts{Index: r.Asc(fileIndexName)})
+func (b *Bucket) ListRegex(pattern string, skip, limit int, reverse bool) (_ []*FileInfo, err error) {
+	defer b.observe("list", time.Now(), &err)
+
+	files, err := b.listRegex(pattern, skip, limit, reverse)
+	if err != nil {
+		return nil, wrapError("list", "", "", err)
 	}
 
-	query = query.Filter(r.Row.Field("filename").Match(pattern))
+	return files, nil
+}
+
+func (b *Bucket) listRegex(pattern string, skip, limit int, reverse bool) ([]*FileInfo, error) {
+	query := b.regexQuery(pattern, reverse)
 
 	if skip > 0 {
 		query = query.Skip(skip)
@@ -25,7 +28,7 @@ func (b *Bucket) ListRegex(pattern string, skip, limit int, reverse bool) ([]*Fi
 		query = query.Limit(limit)
 	}
 
-	cursor, err := query.Run(b.session)
+	cursor, err := query.Without("data").Run(b.exec("list_files", b.filesTable, ""))
 	if err != nil {
 		return nil, err
 	}
@@ -42,20 +45,20 @@ func (b *Bucket) ListRegex(pattern string, skip, limit int, reverse bool) ([]*Fi
 	return files, nil
 }
 
-func (b *Bucket) ListFilename(filename string, skip, limit int, reverse bool) ([]*FileInfo, error) {
-	query := r.DB(b.databaseName).Table(b.filesTable).Between(
-		[]interface{}{StatusComplete, filename, r.MinVal},
-		[]interface{}{StatusComplete, filename, r.MaxVal},
-	).OptArgs(r.BetweenOpts{
-		Index: fileIndexName,
-	})
+func (b *Bucket) ListFilename(filename string, skip, limit int, reverse bool) (_ []*FileInfo, err error) {
+	defer b.observe("list", time.Now(), &err)
 
-	if reverse {
-		query = query.OrderBy(r.OrderByOpts{Index: r.Desc(fileIndexName)})
-	} else {
-		query = query.OrderBy(r.OrderByOpts{Index: r.Asc(fileIndexName)})
+	files, err := b.listFilename(filename, skip, limit, reverse)
+	if err != nil {
+		return nil, wrapError("list", filename, "", err)
 	}
 
+	return files, nil
+}
+
+func (b *Bucket) listFilename(filename string, skip, limit int, reverse bool) ([]*FileInfo, error) {
+	query := b.filenameQuery(filename, reverse)
+
 	if skip > 0 {
 		query = query.Skip(skip)
 	}
@@ -63,7 +66,7 @@ func (b *Bucket) ListFilename(filename string, skip, limit int, reverse bool) ([
 		query = query.Limit(limit)
 	}
 
-	cursor, err := query.Run(b.session)
+	cursor, err := query.Without("data").Run(b.exec("list_files", b.filesTable, ""))
 	if err != nil {
 		return nil, err
 	}
@@ -80,11 +83,19 @@ func (b *Bucket) ListFilename(filename string, skip, limit int, reverse bool) ([
 	return files, nil
 }
 
-func (b *Bucket) ListMetadata(metadata map[string]interface{}, skip, limit int) ([]*FileInfo, error) {
-	query := r.DB(b.databaseName).Table(b.filesTable).Filter(map[string]interface{}{
-		"metadata": metadata,
-		"status":   StatusComplete,
-	})
+func (b *Bucket) ListMetadata(metadata map[string]interface{}, skip, limit int) (_ []*FileInfo, err error) {
+	defer b.observe("list", time.Now(), &err)
+
+	files, err := b.listMetadata(metadata, skip, limit)
+	if err != nil {
+		return nil, wrapError("list", "", "", err)
+	}
+
+	return files, nil
+}
+
+func (b *Bucket) listMetadata(metadata map[string]interface{}, skip, limit int) ([]*FileInfo, error) {
+	query := b.metadataQuery(metadata)
 
 	if skip > 0 {
 		query = query.Skip(skip)
@@ -93,7 +104,120 @@ func (b *Bucket) ListMetadata(metadata map[string]interface{}, skip, limit int)
 		query = query.Limit(limit)
 	}
 
-	cursor, err := query.Run(b.session)
+	cursor, err := query.Without("data").Run(b.exec("list_files", b.filesTable, ""))
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*FileInfo
+	if err := cursor.All(&files); err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		f.bucket = b
+	}
+
+	return files, nil
+}
+
+// CountRegex returns the number of complete files whose filename matches the
+// pattern, counting every revision as ListRegex does.
+func (b *Bucket) CountRegex(pattern string) (_ int, err error) {
+	defer b.observe("count", time.Now(), &err)
+
+	n, err := b.count(b.regexQuery(pattern, false))
+	if err != nil {
+		return 0, wrapError("count", "", "", err)
+	}
+
+	return n, nil
+}
+
+// CountFilename returns the number of complete revisions of the file.
+func (b *Bucket) CountFilename(filename string) (_ int, err error) {
+	defer b.observe("count", time.Now(), &err)
+
+	n, err := b.count(b.filenameQuery(filename, false))
+	if err != nil {
+		return 0, wrapError("count", filename, "", err)
+	}
+
+	return n, nil
+}
+
+// CountMetadata returns the number of complete files with the given metadata.
+func (b *Bucket) CountMetadata(metadata map[string]interface{}) (_ int, err error) {
+	defer b.observe("count", time.Now(), &err)
+
+	n, err := b.count(b.metadataQuery(metadata))
+	if err != nil {
+		return 0, wrapError("count", "", "", err)
+	}
+
+	return n, nil
+}
+
+func (b *Bucket) count(query r.Term) (int, error) {
+	var n int
+	if err := query.Count().ReadOne(&n, b.exec("count_files", b.filesTable, "")); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+func (b *Bucket) regexQuery(pattern string, reverse bool) r.Term {
+	query := b.readTable(b.filesTable).Between(
+		[]interface{}{StatusComplete, r.MinVal},
+		[]interface{}{StatusComplete, r.MaxVal},
+	).OptArgs(r.BetweenOpts{
+		Index: fileIndexName,
+	})
+
+	if reverse {
+		query = query.OrderBy(r.OrderByOpts{Index: r.Desc(fileIndexName)})
+	} else {
+		query = query.OrderBy(r.OrderByOpts{Index: r.Asc(fileIndexName)})
+	}
+
+	return query.Filter(r.Row.Field("filename").Match(pattern))
+}
+
+func (b *Bucket) filenameQuery(filename string, reverse bool) r.Term {
+	query := b.revisions(filename, r.MaxVal)
+
+	if reverse {
+		return query.OrderBy(r.OrderByOpts{Index: r.Desc(fileIndexName)})
+	}
+
+	return query.OrderBy(r.OrderByOpts{Index: r.Asc(fileIndexName)})
+}
+
+func (b *Bucket) metadataQuery(metadata map[string]interface{}) r.Term {
+	return b.readTable(b.filesTable).Filter(map[string]interface{}{
+		"metadata": metadata,
+		"status":   StatusComplete,
+	})
+}
+
+// FindBySha256 returns the complete files whose content has the given
+// SHA-256 hash, encoded as lowercase hex.
+func (b *Bucket) FindBySha256(hash string) (_ []*FileInfo, err error) {
+	defer b.observe("findbysha256", time.Now(), &err)
+
+	files, err := b.findBySha256(hash)
+	if err != nil {
+		return nil, wrapError("findbysha256", "", "", err)
+	}
+
+	return files, nil
+}
+
+func (b *Bucket) findBySha256(hash string) ([]*FileInfo, error) {
+	cursor, err := b.readTable(b.filesTable).GetAllByIndex(
+		hashIndexName, []interface{}{StatusComplete, strings.ToLower(hash)},
+	).OrderBy("finishedAt").Without("data").Run(b.exec("list_files", b.filesTable, ""))
 	if err != nil {
 		return nil, err
 	}
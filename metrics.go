@@ -0,0 +1,43 @@
+package regrid
+
+import (
+	"io"
+	"time"
+)
+
+// Metrics records the activity of a bucket. Implementations must be safe for
+// concurrent use.
+type Metrics interface {
+	// ObserveOperation records the latency of a bucket operation such as
+	// "open" or "create", err is nil if the operation succeeded.
+	ObserveOperation(op string, latency time.Duration, err error)
+	// AddRead and AddWritten record the bytes of content and the number of
+	// chunks read or written.
+	AddRead(bytes, chunks int)
+	AddWritten(bytes, chunks int)
+	// HashMismatch records content which did not match its expected hash.
+	HashMismatch()
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) ObserveOperation(string, time.Duration, error) {}
+func (nopMetrics) AddRead(int, int)                              {}
+func (nopMetrics) AddWritten(int, int)                           {}
+func (nopMetrics) HashMismatch()                                 {}
+
+// observe records an operation started at start which returned *err, it is
+// deferred by the exported methods of the bucket.
+func (b *Bucket) observe(op string, start time.Time, err *error) {
+	b.metrics.ObserveOperation(op, time.Since(start), *err)
+}
+
+// observe records a Read, Write or Close of the file, reaching the end of the
+// file is not an error.
+func (f *File) observe(op string, start time.Time, err *error) {
+	if *err == io.EOF {
+		f.bucket.metrics.ObserveOperation(op, time.Since(start), nil)
+		return
+	}
+	f.bucket.observe(op, start, err)
+}
@@ -0,0 +1,106 @@
+package regrid
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	m := NewPrometheusMetrics("")
+	m.ObserveOperation("open", 20*time.Millisecond, nil)
+	m.ObserveOperation("open", 2*time.Second, ErrNotExist)
+	m.AddRead(100, 1)
+	m.HashMismatch()
+
+	var buf bytes.Buffer
+	_, err := m.WriteTo(&buf)
+	require.Nil(t, err)
+
+	out := buf.String()
+	assert.Contains(t, out, "# TYPE regrid_operations_total counter\n")
+	assert.Contains(t, out, `regrid_operations_total{op="open"} 2`+"\n")
+	assert.Contains(t, out, `regrid_operation_errors_total{op="open"} 1`+"\n")
+	assert.Contains(t, out, `regrid_operation_duration_seconds_bucket{op="open",le="0.01"} 0`+"\n")
+	assert.Contains(t, out, `regrid_operation_duration_seconds_bucket{op="open",le="0.025"} 1`+"\n")
+	assert.Contains(t, out, `regrid_operation_duration_seconds_bucket{op="open",le="+Inf"} 2`+"\n")
+	assert.Contains(t, out, `regrid_operation_duration_seconds_sum{op="open"} 2.02`+"\n")
+	assert.Contains(t, out, "regrid_read_bytes_total 100\n")
+	assert.Contains(t, out, "regrid_read_chunks_total 1\n")
+	assert.Contains(t, out, "regrid_hash_mismatches_total 1\n")
+}
+
+func TestBucketMetrics(t *testing.T) {
+	metrics := NewExpvarMetrics("regrid_metrics_test")
+	bucket := New(session, BucketOptions{
+		DatabaseName:   db,
+		BucketName:     "metrics",
+		ChunkSizeBytes: 500,
+		Metrics:        metrics,
+	})
+	require.Nil(t, bucket.Init())
+
+	src, err := ioutil.ReadFile("files/lipsum.txt")
+	require.Nil(t, err)
+
+	dst, err := bucket.Create("/docs/lipsum.txt", nil)
+	require.Nil(t, err)
+	_, err = dst.Write(src)
+	require.Nil(t, err)
+	require.Nil(t, dst.Close())
+
+	file, err := bucket.Open("/docs/lipsum.txt")
+	require.Nil(t, err)
+	_, err = ioutil.ReadAll(file)
+	require.Nil(t, err)
+	require.Nil(t, file.Close())
+
+	_, err = bucket.Open("/docs/notfound.txt")
+	assert.True(t, errors.Is(err, ErrNotExist))
+
+	dst, err = bucket.CreateWithOptions("/docs/lipsum.txt", CreateOptions{
+		ExpectedSha256: "0000",
+	})
+	require.Nil(t, err)
+	_, err = dst.Write(src)
+	require.Nil(t, err)
+	assert.True(t, errors.Is(dst.Close(), ErrHashMismatch))
+
+	assert.Equal(t, "1", metrics.Operations.Get("init").String())
+	assert.Equal(t, "2", metrics.Operations.Get("create").String())
+	assert.Equal(t, "2", metrics.Operations.Get("open").String())
+	assert.Equal(t, "1", metrics.Errors.Get("open").String())
+	assert.Nil(t, metrics.Errors.Get("create"))
+	assert.Equal(t, int64(2*1417), metrics.BytesWritten.Value())
+	assert.Equal(t, int64(6), metrics.ChunksWritten.Value())
+	assert.Equal(t, int64(1417), metrics.BytesRead.Value())
+	assert.Equal(t, int64(3), metrics.ChunksRead.Value())
+	assert.Equal(t, int64(1), metrics.HashMismatches.Value())
+	assert.Equal(t, "2", metrics.Operations.Get("write").String())
+	assert.Nil(t, metrics.Errors.Get("read"))
+	assert.Equal(t, "3", metrics.Operations.Get("close").String())
+	assert.Equal(t, "1", metrics.Errors.Get("close").String())
+
+	t.Run("CorruptChunk", func(t *testing.T) {
+		require.Nil(t, r.DB(db).Table("metrics_chunks").Filter(map[string]interface{}{
+			"file_id": file.ID,
+			"num":     1,
+		}).Update(map[string]interface{}{
+			"data": []byte("corrupt"),
+		}).Exec(session))
+
+		corrupt, err := bucket.OpenID(file.ID)
+		require.Nil(t, err)
+		_, err = ioutil.ReadAll(corrupt)
+		assert.True(t, errors.Is(err, ErrChecksumMismatch))
+
+		assert.Equal(t, "1", metrics.Errors.Get("read").String())
+		assert.Equal(t, int64(2), metrics.HashMismatches.Value())
+	})
+}
@@ -0,0 +1,36 @@
+package regrid
+
+import r "github.com/dancannon/gorethink"
+
+// migration upgrades the bucket layout to version. Migrations run in order
+// during Init and must be safe to run again if they are interrupted.
+type migration struct {
+	version     int
+	description string
+	migrate     func(b *Bucket) error
+}
+
+var migrations = []migration{
+	{1, "store the SHA-256 hash of complete files in the hashes map", (*Bucket).migrateHashes},
+	{2, "create the heads of existing filenames", (*Bucket).migrateHeads},
+	{3, "number the revisions of existing filenames", (*Bucket).migrateRevisions},
+	{4, "create the filename index", (*Bucket).createFilenameIndex},
+}
+
+// layoutVersion is the version of the bucket layout written by this package.
+func layoutVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+func (b *Bucket) migrateHashes() error {
+	return r.DB(b.databaseName).Table(b.filesTable).Filter(r.And(
+		r.Row.Field("status").Eq(StatusComplete),
+		r.Row.HasFields("hashes").Not(),
+	)).Update(func(file r.Term) interface{} {
+		return map[string]interface{}{
+			"hashes": map[string]interface{}{
+				string(HashSha256): file.Field("sha256"),
+			},
+		}
+	}).Exec(b.exec("migrate_hashes", b.filesTable, ""))
+}
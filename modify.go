@@ -1,11 +1,24 @@
 package regrid
 
-import r "github.com/dancannon/gorethink"
+import (
+	"time"
 
-func (b *Bucket) Delete(id string) error {
+	r "github.com/dancannon/gorethink"
+	"github.com/dancannon/gorethink/encoding"
+)
+
+func (b *Bucket) Delete(id string) (err error) {
+	defer b.observe("delete", time.Now(), &err)
+
+	return wrapError("delete", "", id, b.softDelete(id))
+}
+
+func (b *Bucket) softDelete(id string) error {
 	rsp, err := r.DB(b.databaseName).Table(b.filesTable).Get(id).Update(map[string]interface{}{
 		"status": StatusDeleted,
-	}).RunWrite(b.session)
+	}, r.UpdateOpts{
+		ReturnChanges: true,
+	}).RunWrite(b.exec("update_file", b.filesTable, id))
 	if err != nil {
 		return err
 	}
@@ -13,12 +26,28 @@ func (b *Bucket) Delete(id string) error {
 	if rsp.Replaced == 0 && rsp.Unchanged == 0 {
 		return ErrNotExist
 	}
+	if rsp.Replaced == 0 {
+		return nil
+	}
 
-	return nil
+	var file FileInfo
+	if err := encoding.Decode(&file, rsp.Changes[0].OldValue); err != nil {
+		return err
+	}
+
+	return b.refreshHead(file.Filename, id)
+}
+
+func (b *Bucket) HardDelete(id string) (err error) {
+	defer b.observe("harddelete", time.Now(), &err)
+
+	return wrapError("harddelete", "", id, b.hardDelete(id))
 }
 
-func (b *Bucket) HardDelete(id string) error {
-	rsp, err := r.DB(b.databaseName).Table(b.filesTable).Get(id).Delete().RunWrite(b.session)
+func (b *Bucket) hardDelete(id string) error {
+	rsp, err := r.DB(b.databaseName).Table(b.filesTable).Get(id).Delete(r.DeleteOpts{
+		ReturnChanges: true,
+	}).RunWrite(b.exec("delete_file", b.filesTable, id))
 	if err != nil {
 		return err
 	}
@@ -27,12 +56,49 @@ func (b *Bucket) HardDelete(id string) error {
 		return ErrNotExist
 	}
 
-	err = r.DB(b.databaseName).Table(b.chunksTable).Between(
+	var file FileInfo
+	if err := encoding.Decode(&file, rsp.Changes[0].OldValue); err != nil {
+		return err
+	}
+	if err := b.refreshHead(file.Filename, id); err != nil {
+		return err
+	}
+
+	// Keep the chunks if they are still used by a deduplicated file
+	source := file.chunksID()
+	var shared bool
+	if err := r.Or(
+		r.DB(b.databaseName).Table(b.filesTable).Get(source).Ne(nil),
+		r.DB(b.databaseName).Table(b.filesTable).GetAllByIndex(dataIndexName, source).Count().Gt(0),
+	).ReadOne(&shared, b.exec("find_shared_chunks", b.filesTable, source)); err != nil {
+		return err
+	}
+	if shared {
+		return nil
+	}
+
+	if b.cache != nil {
+		b.cache.Remove(source)
+	}
+
+	return b.deleteChunks(source, file.Dedupe)
+}
+
+// deleteChunks deletes the chunks of a file, releasing their blobs if the
+// chunks were stored with dedupe whatever the options of the bucket.
+func (b *Bucket) deleteChunks(id string, dedupe bool) error {
+	if dedupe {
+		if err := b.releaseBlobs(id); err != nil {
+			return err
+		}
+	}
+
+	err := r.DB(b.databaseName).Table(b.chunksTable).Between(
 		[]interface{}{id, r.MinVal},
 		[]interface{}{id, r.MaxVal},
 	).OptArgs(r.BetweenOpts{
 		Index: chunkIndexName,
-	}).Delete().Exec(b.session)
+	}).Delete().Exec(b.exec("delete_chunks", b.chunksTable, id))
 	if err != nil {
 		return err
 	}
@@ -40,10 +106,30 @@ func (b *Bucket) HardDelete(id string) error {
 	return nil
 }
 
-func (b *Bucket) Rename(id, filename string) error {
+func (b *Bucket) Rename(id, filename string) (err error) {
+	defer b.observe("rename", time.Now(), &err)
+
+	return wrapError("rename", "", id, b.rename(id, filename))
+}
+
+func (b *Bucket) rename(id, filename string) error {
+	// Read the head of the new filename first, so that it is only refreshed
+	// if no other file completes in the meantime
+	head, err := b.currentHead(filename)
+	if err != nil {
+		return err
+	}
+	revision, err := b.assignRevision(filename)
+	if err != nil {
+		return err
+	}
+
 	rsp, err := r.DB(b.databaseName).Table(b.filesTable).Get(id).Update(map[string]interface{}{
 		"filename": filename,
-	}).RunWrite(b.session)
+		"revision": revision,
+	}, r.UpdateOpts{
+		ReturnChanges: true,
+	}).RunWrite(b.exec("update_file", b.filesTable, id))
 	if err != nil {
 		return err
 	}
@@ -51,14 +137,31 @@ func (b *Bucket) Rename(id, filename string) error {
 	if rsp.Replaced == 0 && rsp.Unchanged == 0 {
 		return ErrNotExist
 	}
+	if rsp.Replaced == 0 {
+		return nil
+	}
 
-	return nil
+	var file FileInfo
+	if err := encoding.Decode(&file, rsp.Changes[0].OldValue); err != nil {
+		return err
+	}
+	if err := b.refreshHead(file.Filename, id); err != nil {
+		return err
+	}
+
+	return b.refreshHead(filename, head)
+}
+
+func (b *Bucket) ReplaceMetadata(id string, metadata map[string]interface{}) (err error) {
+	defer b.observe("replacemetadata", time.Now(), &err)
+
+	return wrapError("replacemetadata", "", id, b.replaceMetadata(id, metadata))
 }
 
-func (b *Bucket) ReplaceMetadata(id string, metadata map[string]interface{}) error {
+func (b *Bucket) replaceMetadata(id string, metadata map[string]interface{}) error {
 	rsp, err := r.DB(b.databaseName).Table(b.filesTable).Get(id).Update(map[string]interface{}{
 		"metadata": metadata,
-	}).RunWrite(b.session)
+	}).RunWrite(b.exec("update_file", b.filesTable, id))
 	if err != nil {
 		return err
 	}
@@ -1,6 +1,7 @@
 package regrid
 
 import (
+	"errors"
 	"io"
 	"os"
 	"testing"
@@ -44,12 +45,12 @@ func TestBucketDelete(t *testing.T) {
 		assert.Equal(t, StatusDeleted, file.Status)
 
 		_, err = bucket.Open("/images/saturnV.jpg")
-		assert.Equal(t, ErrNotExist, err)
+		assert.True(t, errors.Is(err, ErrNotExist))
 	})
 
 	t.Run("ErrNotExists", func(t *testing.T) {
 		err := bucket.Delete("notfound")
-		assert.Equal(t, ErrNotExist, err)
+		assert.True(t, errors.Is(err, ErrNotExist))
 	})
 }
 
@@ -83,7 +84,7 @@ func TestBucketHardDelete(t *testing.T) {
 
 		// Download file
 		_, err = bucket.OpenID(dst.ID)
-		assert.Equal(t, ErrNotExist, err)
+		assert.True(t, errors.Is(err, ErrNotExist))
 
 		cur, err := r.DB(db).Table("hard_delete_files").Get(dst.ID).Run(session)
 		assert.Nil(t, err)
@@ -101,7 +102,7 @@ func TestBucketHardDelete(t *testing.T) {
 
 	t.Run("ErrNotExists", func(t *testing.T) {
 		err := bucket.HardDelete("notfound")
-		assert.Equal(t, ErrNotExist, err)
+		assert.True(t, errors.Is(err, ErrNotExist))
 	})
 }
 
@@ -170,7 +171,7 @@ func TestBucketRename(t *testing.T) {
 
 	t.Run("ErrNotExists", func(t *testing.T) {
 		err := bucket.Rename("notfound", "newname")
-		assert.Equal(t, ErrNotExist, err)
+		assert.True(t, errors.Is(err, ErrNotExist))
 	})
 }
 
@@ -211,6 +212,6 @@ func TestBucketReplaceMetadata(t *testing.T) {
 
 	t.Run("ErrNotExists", func(t *testing.T) {
 		err := bucket.ReplaceMetadata("notfound", map[string]interface{}{"foo": "baz"})
-		assert.Equal(t, ErrNotExist, err)
+		assert.True(t, errors.Is(err, ErrNotExist))
 	})
 }
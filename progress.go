@@ -0,0 +1,71 @@
+package regrid
+
+// Progress describes how much of a file has been transferred.
+type Progress struct {
+	// Bytes is the number of bytes of content transferred so far.
+	Bytes int
+	// Chunk is the number of the chunk which was just transferred.
+	Chunk int
+	// Total is the length of the file, or 0 when uploading without an
+	// ExpectedLength.
+	Total int
+}
+
+// Callbacks are notified as a file is uploaded or downloaded. Callbacks are
+// called from the goroutine reading or writing the file.
+type Callbacks struct {
+	// OnProgress is called after each chunk is transferred, the content of
+	// inline files is reported as chunk 0.
+	OnProgress func(Progress)
+	// OnComplete is called once an upload has been closed successfully or a
+	// download has been read to the end and verified.
+	OnComplete func(*FileInfo)
+	// OnError is called with the first error which fails the transfer.
+	OnError func(error)
+}
+
+// SetCallbacks sets the callbacks notified of the transfer of this file, it
+// must be called before the first Read or Write. Files opened by OpenID,
+// OpenRevision or OpenAt get their callbacks this way.
+func (f *File) SetCallbacks(callbacks Callbacks) {
+	f.callbacks = callbacks
+}
+
+func (f *File) reportProgress(chunk int) {
+	if f.callbacks.OnProgress == nil {
+		return
+	}
+
+	total := f.Length
+	if f.mode == fileModeWrite {
+		total = 0
+		if f.expectedLength != nil {
+			total = *f.expectedLength
+		}
+	}
+
+	f.callbacks.OnProgress(Progress{
+		Bytes: f.transferred,
+		Chunk: chunk,
+		Total: total,
+	})
+}
+
+// reportDone calls the completion or failure callback, only the first call
+// for a file has any effect.
+func (f *File) reportDone(err error) {
+	if f.done {
+		return
+	}
+	f.done = true
+
+	if err != nil {
+		if f.callbacks.OnError != nil {
+			f.callbacks.OnError(err)
+		}
+		return
+	}
+	if f.callbacks.OnComplete != nil {
+		f.callbacks.OnComplete(f.FileInfo)
+	}
+}
@@ -0,0 +1,145 @@
+package regrid
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCallbacks(t *testing.T) {
+	bucket := New(session, BucketOptions{
+		DatabaseName:   db,
+		BucketName:     "progress",
+		ChunkSizeBytes: 500,
+	})
+	require.Nil(t, bucket.Init())
+
+	src, err := ioutil.ReadFile("files/lipsum.txt")
+	require.Nil(t, err)
+
+	type recorder struct {
+		progress []Progress
+		complete *FileInfo
+		err      error
+	}
+	callbacks := func(rec *recorder) Callbacks {
+		return Callbacks{
+			OnProgress: func(p Progress) {
+				rec.progress = append(rec.progress, p)
+			},
+			OnComplete: func(fi *FileInfo) {
+				rec.complete = fi
+			},
+			OnError: func(err error) {
+				rec.err = err
+			},
+		}
+	}
+
+	t.Run("Upload", func(t *testing.T) {
+		var rec recorder
+		length := len(src)
+		dst, err := bucket.CreateWithOptions("/docs/lipsum.txt", CreateOptions{
+			ExpectedLength: &length,
+			Callbacks:      callbacks(&rec),
+		})
+		require.Nil(t, err)
+		_, err = dst.Write(src)
+		require.Nil(t, err)
+		require.Nil(t, dst.Close())
+
+		assert.Equal(t, []Progress{
+			{Bytes: 500, Chunk: 0, Total: 1417},
+			{Bytes: 1000, Chunk: 1, Total: 1417},
+			{Bytes: 1417, Chunk: 2, Total: 1417},
+		}, rec.progress)
+		if assert.NotNil(t, rec.complete) {
+			assert.Equal(t, StatusComplete, rec.complete.Status)
+			assert.Equal(t, "1748f5745c3ef44ba4e1f212069f6e90e29d61bdd320a48c0b06e1255864ed4f", rec.complete.Sha256)
+		}
+		assert.Nil(t, rec.err)
+	})
+
+	t.Run("Download", func(t *testing.T) {
+		var rec recorder
+		file, err := bucket.OpenWithOptions("/docs/lipsum.txt", OpenOptions{
+			Callbacks: callbacks(&rec),
+		})
+		require.Nil(t, err)
+
+		data, err := ioutil.ReadAll(file)
+		require.Nil(t, err)
+		assert.Equal(t, src, data)
+
+		assert.Equal(t, []Progress{
+			{Bytes: 500, Chunk: 0, Total: 1417},
+			{Bytes: 1000, Chunk: 1, Total: 1417},
+			{Bytes: 1417, Chunk: 2, Total: 1417},
+		}, rec.progress)
+		assert.NotNil(t, rec.complete)
+		assert.Nil(t, rec.err)
+	})
+
+	t.Run("Failure", func(t *testing.T) {
+		var rec recorder
+		length := 10
+		dst, err := bucket.CreateWithOptions("/docs/lipsum.txt", CreateOptions{
+			ExpectedLength: &length,
+			Callbacks:      callbacks(&rec),
+		})
+		require.Nil(t, err)
+		_, err = dst.Write(bytes.Repeat([]byte("a"), 20))
+		require.Nil(t, err)
+		assert.True(t, errors.Is(dst.Close(), ErrLengthMismatch))
+
+		assert.Nil(t, rec.complete)
+		assert.True(t, errors.Is(rec.err, ErrLengthMismatch))
+	})
+
+	t.Run("SetCallbacks", func(t *testing.T) {
+		var rec recorder
+		latest, err := bucket.Open("/docs/lipsum.txt")
+		require.Nil(t, err)
+		file, err := bucket.OpenID(latest.ID)
+		require.Nil(t, err)
+		file.SetCallbacks(callbacks(&rec))
+
+		_, err = ioutil.ReadAll(file)
+		require.Nil(t, err)
+		assert.Len(t, rec.progress, 3)
+		assert.NotNil(t, rec.complete)
+	})
+
+	t.Run("Inline", func(t *testing.T) {
+		bucket := New(session, BucketOptions{
+			DatabaseName:         db,
+			BucketName:           "progress_inline",
+			InlineThresholdBytes: 2000,
+		})
+		require.Nil(t, bucket.Init())
+
+		var rec recorder
+		dst, err := bucket.CreateWithOptions("/docs/lipsum.txt", CreateOptions{
+			Callbacks: callbacks(&rec),
+		})
+		require.Nil(t, err)
+		_, err = dst.Write(src)
+		require.Nil(t, err)
+		require.Nil(t, dst.Close())
+		assert.Equal(t, []Progress{{Bytes: 1417, Chunk: 0, Total: 0}}, rec.progress)
+
+		rec = recorder{}
+		file, err := bucket.OpenWithOptions("/docs/lipsum.txt", OpenOptions{
+			Callbacks: callbacks(&rec),
+		})
+		require.Nil(t, err)
+		_, err = ioutil.ReadAll(file)
+		require.Nil(t, err)
+		assert.Equal(t, []Progress{{Bytes: 1417, Chunk: 0, Total: 1417}}, rec.progress)
+		assert.NotNil(t, rec.complete)
+	})
+}
@@ -0,0 +1,163 @@
+package regrid
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultLatencyBuckets are the upper bounds in seconds of the operation
+// latency histogram buckets.
+var DefaultLatencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// PrometheusMetrics records the metrics of a bucket and exposes them in the
+// Prometheus text format, it can be served directly as the scrape endpoint.
+type PrometheusMetrics struct {
+	namespace string
+	buckets   []float64
+
+	mu             sync.Mutex
+	operations     map[string]*operationMetrics
+	bytesRead      int64
+	bytesWritten   int64
+	chunksRead     int64
+	chunksWritten  int64
+	hashMismatches int64
+}
+
+type operationMetrics struct {
+	count, errors int64
+	seconds       float64
+	// buckets counts the operations no slower than each bound
+	buckets []int64
+}
+
+// NewPrometheusMetrics returns metrics whose names start with the namespace,
+// which defaults to "regrid".
+func NewPrometheusMetrics(namespace string) *PrometheusMetrics {
+	if namespace == "" {
+		namespace = "regrid"
+	}
+
+	return &PrometheusMetrics{
+		namespace:  namespace,
+		buckets:    DefaultLatencyBuckets,
+		operations: map[string]*operationMetrics{},
+	}
+}
+
+func (m *PrometheusMetrics) ObserveOperation(op string, latency time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	o, ok := m.operations[op]
+	if !ok {
+		o = &operationMetrics{buckets: make([]int64, len(m.buckets))}
+		m.operations[op] = o
+	}
+
+	seconds := latency.Seconds()
+	o.count++
+	if err != nil {
+		o.errors++
+	}
+	o.seconds += seconds
+	for i, bound := range m.buckets {
+		if seconds <= bound {
+			o.buckets[i]++
+		}
+	}
+}
+
+func (m *PrometheusMetrics) AddRead(bytes, chunks int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.bytesRead += int64(bytes)
+	m.chunksRead += int64(chunks)
+}
+
+func (m *PrometheusMetrics) AddWritten(bytes, chunks int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.bytesWritten += int64(bytes)
+	m.chunksWritten += int64(chunks)
+}
+
+func (m *PrometheusMetrics) HashMismatch() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.hashMismatches++
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (m *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var buf bytes.Buffer
+
+	ops := make([]string, 0, len(m.operations))
+	for op := range m.operations {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	name := m.namespace + "_operations_total"
+	writeMetricHeader(&buf, name, "counter", "Number of bucket operations.")
+	for _, op := range ops {
+		fmt.Fprintf(&buf, "%s{op=%q} %d\n", name, op, m.operations[op].count)
+	}
+
+	name = m.namespace + "_operation_errors_total"
+	writeMetricHeader(&buf, name, "counter", "Number of bucket operations which failed.")
+	for _, op := range ops {
+		fmt.Fprintf(&buf, "%s{op=%q} %d\n", name, op, m.operations[op].errors)
+	}
+
+	name = m.namespace + "_operation_duration_seconds"
+	writeMetricHeader(&buf, name, "histogram", "Latency of bucket operations.")
+	for _, op := range ops {
+		o := m.operations[op]
+		for i, bound := range m.buckets {
+			fmt.Fprintf(&buf, "%s_bucket{op=%q,le=%q} %d\n", name, op, strconv.FormatFloat(bound, 'g', -1, 64), o.buckets[i])
+		}
+		fmt.Fprintf(&buf, "%s_bucket{op=%q,le=\"+Inf\"} %d\n", name, op, o.count)
+		fmt.Fprintf(&buf, "%s_sum{op=%q} %s\n", name, op, strconv.FormatFloat(o.seconds, 'g', -1, 64))
+		fmt.Fprintf(&buf, "%s_count{op=%q} %d\n", name, op, o.count)
+	}
+
+	for _, counter := range []struct {
+		name, help string
+		value      int64
+	}{
+		{"read_bytes_total", "Bytes of file content read.", m.bytesRead},
+		{"written_bytes_total", "Bytes of file content written.", m.bytesWritten},
+		{"read_chunks_total", "Number of chunks read.", m.chunksRead},
+		{"written_chunks_total", "Number of chunks inserted.", m.chunksWritten},
+		{"hash_mismatches_total", "Number of files whose content did not match the expected hash.", m.hashMismatches},
+	} {
+		name = m.namespace + "_" + counter.name
+		writeMetricHeader(&buf, name, "counter", counter.help)
+		fmt.Fprintf(&buf, "%s %d\n", name, counter.value)
+	}
+
+	return buf.WriteTo(w)
+}
+
+func writeMetricHeader(buf *bytes.Buffer, name, typ, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// ServeHTTP serves the metrics for scraping by Prometheus.
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
@@ -1,60 +1,214 @@
 package regrid
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"io"
+	"time"
 
 	r "github.com/dancannon/gorethink"
 )
 
-func (b *Bucket) Open(filename string) (*File, error) {
-	return b.OpenRevision(filename, -1)
+func (b *Bucket) Open(filename string) (_ *File, err error) {
+	defer b.observe("open", time.Now(), &err)
+
+	file, err := b.openRevision(filename, -1)
+	if err != nil {
+		return nil, wrapError("open", filename, "", err)
+	}
+
+	return file, nil
 }
 
-func (b *Bucket) OpenRevision(filename string, revision int) (*File, error) {
-	var revSteps int
+type OpenOptions struct {
+	// Callbacks are notified of the progress of the download.
+	Callbacks Callbacks
+}
 
-	query := r.DB(b.databaseName).Table(b.filesTable).Between(
-		[]interface{}{StatusComplete, filename, r.MinVal},
-		[]interface{}{StatusComplete, filename, r.MaxVal},
-	).OptArgs(r.BetweenOpts{
-		Index: fileIndexName,
-	})
+// OpenWithOptions opens the latest complete revision of the file.
+func (b *Bucket) OpenWithOptions(filename string, options OpenOptions) (*File, error) {
+	file, err := b.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	file.SetCallbacks(options.Callbacks)
+
+	return file, nil
+}
+
+// OpenRevision opens a complete revision of the file by the revision number
+// stored when it was completed, see RevisionInfo. Negative numbers count back
+// from -1 for the latest revision.
+func (b *Bucket) OpenRevision(filename string, revision int) (_ *File, err error) {
+	defer b.observe("open", time.Now(), &err)
+
+	file, err := b.openRevision(filename, revision)
+	if err != nil {
+		return nil, wrapRevisionError("open", filename, revision, err)
+	}
+
+	return file, nil
+}
+
+func (b *Bucket) openRevision(filename string, revision int) (*File, error) {
+	query := b.revisions(filename, r.MaxVal)
 	if revision >= 0 {
-		revSteps = revision
-		query = query.OrderBy(r.OrderByOpts{Index: r.Asc(fileIndexName)})
+		query = query.Filter(r.Row.Field("revision").Default(nil).Eq(revision))
 	} else {
-		revSteps = (revision * -1) - 1
-		query = query.OrderBy(r.OrderByOpts{Index: r.Desc(fileIndexName)})
+		query = query.OrderBy(r.OrderByOpts{
+			Index: r.Desc(fileIndexName),
+		}).Skip((revision * -1) - 1)
+	}
+
+	file, err := b.openFirst(query)
+	if err != nil || file != nil {
+		return file, err
+	}
+
+	// Only check whether any revision exists once the requested one is missing
+	exists, err := b.exists(filename)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrNotExist
 	}
 
-	var files []*File
-	cur, err := query.Run(b.session)
+	return nil, ErrRevisionNotExist
+}
+
+// OpenAt opens the revision of the file which was the latest complete
+// revision at the given time.
+func (b *Bucket) OpenAt(filename string, at time.Time) (_ *File, err error) {
+	defer b.observe("open", time.Now(), &err)
+
+	file, err := b.openAt(filename, at)
+	if err != nil {
+		return nil, wrapError("open", filename, "", err)
+	}
+
+	return file, nil
+}
+
+func (b *Bucket) openAt(filename string, at time.Time) (*File, error) {
+	file, err := b.openFirst(b.revisions(filename, at).OrderBy(r.OrderByOpts{
+		Index: r.Desc(fileIndexName),
+	}))
 	if err != nil {
 		return nil, err
 	}
+	if file == nil {
+		return nil, ErrNotExist
+	}
+
+	return file, nil
+}
+
+// RevisionInfo describes a complete revision of a file. Revision is the
+// number passed to OpenRevision to open it. Revisions of a filename are
+// numbered from 0 in the order they complete and keep their number when other
+// revisions are deleted, a file renamed to the filename gets the next number.
+type RevisionInfo struct {
+	*FileInfo
+	Revision int
+}
+
+// Revisions returns the complete revisions of the file, oldest first.
+func (b *Bucket) Revisions(filename string) (_ []*RevisionInfo, err error) {
+	defer b.observe("revisions", time.Now(), &err)
+
+	revisions, err := b.listRevisions(filename)
+	if err != nil {
+		return nil, wrapError("revisions", filename, "", err)
+	}
+
+	return revisions, nil
+}
 
-	if err := cur.All(&files); err != nil {
+func (b *Bucket) listRevisions(filename string) ([]*RevisionInfo, error) {
+	cursor, err := b.revisions(filename, r.MaxVal).OrderBy(r.OrderByOpts{
+		Index: r.Asc(fileIndexName),
+	}).Without("data").Run(b.exec("list_revisions", b.filesTable, ""))
+	if err != nil {
 		return nil, err
 	}
+	defer cursor.Close()
+
+	var revisions []*RevisionInfo
+	for {
+		var fi *FileInfo
+		if !cursor.Next(&fi) {
+			break
+		}
 
-	if len(files) == 0 {
+		fi.bucket = b
+		revisions = append(revisions, &RevisionInfo{
+			FileInfo: fi,
+			Revision: fi.Revision,
+		})
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	if len(revisions) == 0 {
 		return nil, ErrNotExist
 	}
-	if len(files) < (revSteps + 1) {
-		return nil, ErrRevisionNotExist
+
+	return revisions, nil
+}
+
+// revisions selects the complete revisions of the file finished no later than
+// the given time, which may be r.MaxVal.
+func (b *Bucket) revisions(filename string, until interface{}) r.Term {
+	return revisionsIn(b.readTable(b.filesTable), filename, until)
+}
+
+func revisionsIn(files r.Term, filename string, until interface{}) r.Term {
+	return files.Between(
+		[]interface{}{StatusComplete, filename, r.MinVal},
+		[]interface{}{StatusComplete, filename, until},
+	).OptArgs(r.BetweenOpts{
+		Index:      fileIndexName,
+		RightBound: "closed",
+	})
+}
+
+// openFirst returns the first file selected by the query or nil if the query
+// selects nothing.
+func (b *Bucket) openFirst(query r.Term) (*File, error) {
+	fi, err := b.statFirst(query)
+	if err != nil || fi == nil {
+		return nil, err
 	}
 
-	file := files[revSteps]
+	return &File{
+		FileInfo: fi,
+		bucket:   b,
+	}, nil
+}
 
-	file.bucket = b
+// latestRevisionID returns the ID of the latest complete revision of the
+// file or nil if no revision exists. It ignores the read mode of the bucket
+// as it is used to update the head of the filename.
+func (b *Bucket) latestRevisionID(filename string) r.Term {
+	files := r.DB(b.databaseName).Table(b.filesTable)
+
+	return revisionsIn(files, filename, r.MaxVal).OrderBy(r.OrderByOpts{
+		Index: r.Desc(fileIndexName),
+	}).Limit(1).Field("id").Nth(0).Default(nil)
+}
+
+func (b *Bucket) OpenID(id string) (_ *File, err error) {
+	defer b.observe("open", time.Now(), &err)
+
+	file, err := b.openID(id)
+	if err != nil {
+		return nil, wrapError("open", "", id, err)
+	}
 
 	return file, nil
 }
 
-func (b *Bucket) OpenID(id string) (*File, error) {
-	cur, err := r.DB(b.databaseName).Table(b.filesTable).Get(id).Run(b.session)
+func (b *Bucket) openID(id string) (*File, error) {
+	cur, err := b.readTable(b.filesTable).Get(id).Run(b.exec("get_file", b.filesTable, id))
 	if err != nil {
 		return nil, err
 	}
@@ -77,8 +231,18 @@ func (f *File) Read(b []byte) (n int, err error) {
 	if f == nil || f.bucket == nil {
 		return 0, ErrInvalid
 	}
+	defer f.observe("read", time.Now(), &err)
+
+	if f.closed {
+		return 0, wrapError("read", f.Filename, f.ID, ErrClosed)
+	}
+	if f.mode != fileModeRead {
+		return 0, wrapError("read", f.Filename, f.ID, ErrInvalid)
+	}
 	if !f.opened {
 		if err := f.open(); err != nil {
+			err = wrapError("read", f.Filename, f.ID, err)
+			f.reportDone(err)
 			return 0, err
 		}
 	}
@@ -86,33 +250,98 @@ func (f *File) Read(b []byte) (n int, err error) {
 
 	// If we have finished reading all the chunks then compare the hash values
 	if n == 0 && err == nil {
-		sha256 := hex.EncodeToString(f.hash.Sum(nil))
-		if sha256 != f.Sha256 {
-			return 0, ErrHashMismatch
+		if err := f.verifyHashes(f.bucket.verifyHashes); err != nil {
+			err = wrapError("read", f.Filename, f.ID, err)
+			f.reportDone(err)
+			return 0, err
 		}
 	}
 	if n == 0 && len(b) > 0 && err == nil {
+		f.reportDone(nil)
 		return 0, io.EOF
 	}
+	if err != nil {
+		err = wrapError("read", f.Filename, f.ID, err)
+		f.reportDone(err)
+	}
 	return n, err
 }
 
 func (f *File) open() (err error) {
 	f.opened = true
-	f.hash = sha256.New()
-	f.cursor, err = r.DB(f.bucket.databaseName).Table(f.bucket.chunksTable).Between(
-		[]interface{}{f.ID, r.MinVal},
-		[]interface{}{f.ID, r.MaxVal},
+	if err := f.bucket.ensureConfig(); err != nil {
+		return err
+	}
+	if err := f.resetHashes(f.bucket.verifyHashes); err != nil {
+		return err
+	}
+
+	if f.Inline {
+		// Listing queries leave out the inline data so it may need fetching
+		if f.InlineData == nil && f.Length > 0 {
+			err = f.bucket.readTable(f.bucket.filesTable).Get(f.ID).Field("data").ReadOne(&f.InlineData, f.bucket.exec("get_inline_data", f.bucket.filesTable, f.ID))
+			if err != nil {
+				return err
+			}
+		}
+		f.buf = f.InlineData
+		f.writeHashes(f.buf)
+		f.transferred = len(f.buf)
+		f.bucket.metrics.AddRead(len(f.buf), 0)
+		if len(f.buf) > 0 {
+			f.reportProgress(0)
+		}
+		return nil
+	}
+
+	// Cached files open the chunks cursor once a chunk is missing from the
+	// cache
+	if f.cacheable() {
+		return nil
+	}
+
+	return f.bucket.retry.do(f.openChunks)
+}
+
+// openChunks opens a cursor over the chunks of the file starting from the
+// next chunk to be read.
+func (f *File) openChunks() (err error) {
+	query := f.bucket.readTable(f.bucket.chunksTable).Between(
+		[]interface{}{f.chunksID(), f.next},
+		[]interface{}{f.chunksID(), r.MaxVal},
 	).OptArgs(r.BetweenOpts{
 		Index: chunkIndexName,
 	}).OrderBy(r.OrderByOpts{
 		Index: chunkIndexName,
-	}).Run(f.bucket.session)
+	})
+	if f.Dedupe {
+		query = f.bucket.joinBlobs(query)
+	}
+
+	f.cursor, err = query.Run(f.bucket.execChunk("get_chunks", f.ID, f.next))
 
 	return
 }
 
+// reopenChunks replaces a cursor which failed with err, if the error is
+// transient and the retry policy allows, so reading resumes after the last
+// chunk read.
+func (f *File) reopenChunks(err error) error {
+	f.attempts++
+	if !f.bucket.retry.retry(f.attempts, err) {
+		return err
+	}
+
+	f.cursor.Close()
+	f.cursor = nil
+
+	return f.bucket.retry.do(f.openChunks)
+}
+
 func (f *File) closeRead() error {
+	if f.cursor == nil {
+		return nil
+	}
 	return f.cursor.Close()
 }
 
@@ -122,23 +351,63 @@ func (f *File) read(b []byte) (n int, err error) {
 			return n, nil
 		}
 		if len(f.buf) > 0 {
-			n, f.buf = copy(b, f.buf), nil
+			m := copy(b[n:], f.buf)
+			n += m
+			f.buf = f.buf[m:]
 		} else {
+			if f.cursor == nil {
+				if !f.cacheable() || f.transferred >= f.Length {
+					return n, nil
+				}
+				if data, ok := f.bucket.cache.Get(f.chunksID(), f.next); ok {
+					f.consume(f.next, data)
+					f.next++
+					continue
+				}
+				if err := f.bucket.retry.do(f.openChunks); err != nil {
+					return 0, err
+				}
+			}
+
 			var chunk *Chunk
 			more := f.cursor.Next(&chunk)
-			if more {
-				f.hash.Write(chunk.Data)
-				f.buf = chunk.Data
+			if err := f.cursor.Err(); err != nil {
+				if err := f.reopenChunks(err); err != nil {
+					return 0, err
+				}
+				continue
+			}
+			if !more {
+				return n, nil
 			}
+			f.attempts = 0
+			f.next = chunk.Num + 1
+			f.throttle(len(chunk.Data))
 
-			err = f.cursor.Err()
+			if err := chunk.verify(f.ID); err != nil {
+				f.bucket.metrics.HashMismatch()
+				return 0, err
+			}
+			data, err := f.decryptChunk(chunk)
 			if err != nil {
 				return 0, err
 			}
-
-			if !more && len(f.buf) == 0 {
-				return n, nil
+			if data, err = decompressChunk(f.Compression, data); err != nil {
+				return 0, err
 			}
+			if f.cacheable() {
+				f.bucket.cache.Put(f.chunksID(), chunk.Num, data)
+			}
+			f.consume(chunk.Num, data)
 		}
 	}
 }
+
+// consume makes the content of a chunk available to read.
+func (f *File) consume(num int, data []byte) {
+	f.writeHashes(data)
+	f.buf = data
+	f.transferred += len(data)
+	f.bucket.metrics.AddRead(len(data), 1)
+	f.reportProgress(num)
+}
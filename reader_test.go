@@ -1,12 +1,17 @@
 package regrid
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"io"
+	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
+	r "github.com/dancannon/gorethink"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -44,10 +49,38 @@ func TestBucketOpen(t *testing.T) {
 		assert.Equal(t, hex.EncodeToString(fileHash.Sum(nil)), hex.EncodeToString(gridHash.Sum(nil)))
 	})
 
+	t.Run("SmallChunks", func(t *testing.T) {
+		bucket := New(session, BucketOptions{
+			DatabaseName:   db,
+			BucketName:     "open_small_chunks",
+			ChunkSizeBytes: 100,
+		})
+		require.Nil(t, bucket.Init())
+
+		src, err := ioutil.ReadFile("files/lipsum.txt")
+		require.Nil(t, err)
+
+		dst, err := bucket.Create("/docs/lipsum.txt", nil)
+		require.Nil(t, err)
+		_, err = dst.Write(src)
+		require.Nil(t, err)
+		require.Nil(t, dst.Close())
+
+		// Read with a buffer which spans several chunks and does not line up
+		// with the chunk boundaries
+		file, err := bucket.Open("/docs/lipsum.txt")
+		require.Nil(t, err)
+
+		var buf bytes.Buffer
+		_, err = io.CopyBuffer(struct{ io.Writer }{&buf}, file, make([]byte, 333))
+		require.Nil(t, err)
+		assert.Equal(t, src, buf.Bytes())
+	})
+
 	t.Run("ErrNotExists", func(t *testing.T) {
 		file, err := bucket.Open("/images/notfound.jpg")
 		assert.Nil(t, file)
-		assert.Equal(t, ErrNotExist, err)
+		assert.True(t, errors.Is(err, ErrNotExist))
 	})
 }
 
@@ -101,13 +134,147 @@ func TestBucketOpenRevision(t *testing.T) {
 	t.Run("ErrRevisionNotExist", func(t *testing.T) {
 		file, err := bucket.OpenRevision("/docs/document.txt", 2)
 		assert.Nil(t, file)
-		assert.Equal(t, ErrRevisionNotExist, err)
+		assert.True(t, errors.Is(err, ErrRevisionNotExist))
 	})
 
 	t.Run("ErrNotExists", func(t *testing.T) {
 		file, err := bucket.OpenRevision("/images/notfound.jpg", 1)
 		assert.Nil(t, file)
-		assert.Equal(t, ErrNotExist, err)
+		assert.True(t, errors.Is(err, ErrNotExist))
+	})
+}
+
+func TestBucketRevisions(t *testing.T) {
+	bucket := New(session, BucketOptions{
+		DatabaseName: db,
+		BucketName:   "revisions",
+	})
+	require.Nil(t, bucket.Init())
+
+	var finishedAt []time.Time
+	for _, content := range []string{"one", "two", "three"} {
+		dst, err := bucket.Create("/docs/document.txt", nil)
+		require.Nil(t, err)
+		_, err = dst.Write([]byte(content))
+		require.Nil(t, err)
+		require.Nil(t, dst.Close())
+		finishedAt = append(finishedAt, dst.FinishedAt)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Run("Revisions", func(t *testing.T) {
+		revisions, err := bucket.Revisions("/docs/document.txt")
+		require.Nil(t, err)
+		require.Len(t, revisions, 3)
+
+		for i, revision := range revisions {
+			assert.Equal(t, i, revision.Revision)
+
+			file, err := bucket.OpenRevision("/docs/document.txt", revision.Revision)
+			require.Nil(t, err)
+			assert.Equal(t, revision.ID, file.ID)
+		}
+		assert.Equal(t, 5, revisions[2].Length)
+	})
+
+	t.Run("OpenAt", func(t *testing.T) {
+		file, err := bucket.OpenAt("/docs/document.txt", finishedAt[1])
+		require.Nil(t, err)
+		assert.Equal(t, 3, file.Length)
+
+		file, err = bucket.OpenAt("/docs/document.txt", finishedAt[1].Add(5*time.Millisecond))
+		require.Nil(t, err)
+		assert.Equal(t, 3, file.Length)
+
+		file, err = bucket.OpenAt("/docs/document.txt", time.Now())
+		require.Nil(t, err)
+		assert.Equal(t, 5, file.Length)
+	})
+
+	t.Run("ErrNotExists", func(t *testing.T) {
+		_, err := bucket.OpenAt("/docs/document.txt", finishedAt[0].Add(-time.Second))
+		assert.True(t, errors.Is(err, ErrNotExist))
+
+		_, err = bucket.Revisions("/images/notfound.jpg")
+		assert.True(t, errors.Is(err, ErrNotExist))
+	})
+
+	t.Run("Stable", func(t *testing.T) {
+		revisions, err := bucket.Revisions("/docs/document.txt")
+		require.Nil(t, err)
+		require.Nil(t, bucket.HardDelete(revisions[0].ID))
+
+		// Later revisions keep their numbers
+		remaining, err := bucket.Revisions("/docs/document.txt")
+		require.Nil(t, err)
+		require.Len(t, remaining, 2)
+		assert.Equal(t, revisions[1].ID, remaining[0].ID)
+		assert.Equal(t, 1, remaining[0].Revision)
+
+		_, err = bucket.OpenRevision("/docs/document.txt", 0)
+		assert.True(t, errors.Is(err, ErrRevisionNotExist))
+		file, err := bucket.OpenRevision("/docs/document.txt", 1)
+		require.Nil(t, err)
+		assert.Equal(t, revisions[1].ID, file.ID)
+
+		// A renamed file is numbered after the existing revisions
+		dst, err := bucket.Create("/docs/other.txt", nil)
+		require.Nil(t, err)
+		require.Nil(t, dst.Close())
+		require.Nil(t, bucket.Rename(dst.ID, "/docs/document.txt"))
+
+		file, err = bucket.OpenRevision("/docs/document.txt", 3)
+		require.Nil(t, err)
+		assert.Equal(t, dst.ID, file.ID)
+		assert.Equal(t, 3, file.Revision)
+	})
+}
+
+func TestBucketReadMode(t *testing.T) {
+	bucket := New(session, BucketOptions{
+		DatabaseName:   db,
+		BucketName:     "read_mode",
+		ChunkSizeBytes: 100,
+		ReadMode:       ReadModeMajority,
+	})
+	require.Nil(t, bucket.Init())
+
+	src, err := ioutil.ReadFile("files/lipsum.txt")
+	require.Nil(t, err)
+
+	dst, err := bucket.Create("/docs/lipsum.txt", nil)
+	require.Nil(t, err)
+	_, err = dst.Write(src)
+	require.Nil(t, err)
+	require.Nil(t, dst.Close())
+
+	for _, mode := range []ReadMode{ReadModeDefault, ReadModeSingle, ReadModeMajority, ReadModeOutdated} {
+		t.Run(string(mode), func(t *testing.T) {
+			b, err := bucket.WithReadMode(mode)
+			require.Nil(t, err)
+
+			file, err := b.Open("/docs/lipsum.txt")
+			require.Nil(t, err)
+			data, err := ioutil.ReadAll(file)
+			require.Nil(t, err)
+			assert.Equal(t, src, data)
+
+			files, err := b.ListFilename("/docs/lipsum.txt", 0, 0, false)
+			require.Nil(t, err)
+			assert.Len(t, files, 1)
+		})
+	}
+
+	t.Run("ErrInvalid", func(t *testing.T) {
+		bucket := New(session, BucketOptions{
+			DatabaseName: db,
+			BucketName:   "read_mode",
+			ReadMode:     "eventual",
+		})
+		assert.True(t, errors.Is(bucket.Init(), ErrInvalid))
+
+		_, err := bucket.WithReadMode("eventual")
+		assert.True(t, errors.Is(err, ErrInvalid))
 	})
 }
 
@@ -147,6 +314,49 @@ func TestBucketOpenID(t *testing.T) {
 	t.Run("ErrNotExists", func(t *testing.T) {
 		file, err := bucket.OpenID("notfound")
 		assert.Nil(t, file)
-		assert.Equal(t, ErrNotExist, err)
+		assert.True(t, errors.Is(err, ErrNotExist))
+	})
+}
+
+func TestBucketOpenCorruptChunk(t *testing.T) {
+	bucket := New(session, BucketOptions{
+		DatabaseName:   db,
+		BucketName:     "open_corrupt_chunk",
+		ChunkSizeBytes: 500,
 	})
+	require.Nil(t, bucket.Init())
+
+	src, err := ioutil.ReadFile("files/lipsum.txt")
+	require.Nil(t, err)
+
+	dst, err := bucket.Create("/docs/lipsum.txt", nil)
+	require.Nil(t, err)
+	_, err = dst.Write(src)
+	require.Nil(t, err)
+	require.Nil(t, dst.Close())
+
+	require.Nil(t, r.DB(db).Table("open_corrupt_chunk_chunks").Filter(map[string]interface{}{
+		"file_id": dst.ID,
+		"num":     1,
+	}).Update(map[string]interface{}{
+		"data": []byte("corrupt"),
+	}).Exec(session))
+
+	file, err := bucket.OpenID(dst.ID)
+	require.Nil(t, err)
+
+	// The first chunk is still returned, the error is reported as soon as the
+	// corrupt chunk is reached rather than at the end of the file
+	buf := make([]byte, 500)
+	n, err := file.Read(buf)
+	require.Nil(t, err)
+	assert.Equal(t, src[:500], buf[:n])
+
+	_, err = file.Read(buf)
+	var chunkErr *ChunkError
+	if assert.True(t, errors.As(err, &chunkErr)) {
+		assert.Equal(t, dst.ID, chunkErr.FileID)
+		assert.Equal(t, 1, chunkErr.Num)
+	}
+	assert.True(t, errors.Is(err, ErrChecksumMismatch))
 }
@@ -0,0 +1,76 @@
+package regrid
+
+import (
+	"strings"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+)
+
+// RetryPolicy controls how operations which are safe to repeat are retried
+// after a transient failure, such as a connection error or a primary replica
+// being re-elected. Chunk inserts are retried and reads resume from the last
+// chunk read.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times an operation is attempted, values
+	// below 2 disable retries.
+	MaxAttempts int
+	// Backoff is the delay before the first retry, it doubles for each
+	// further retry up to MaxBackoff if MaxBackoff is set.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+func (p RetryPolicy) do(fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if !p.retry(attempt, err) {
+			return err
+		}
+	}
+}
+
+// retry reports whether an operation which failed with err on the given
+// attempt should be retried, waiting for the backoff before returning.
+func (p RetryPolicy) retry(attempt int, err error) bool {
+	if err == nil || attempt >= p.MaxAttempts || !isTransient(err) {
+		return false
+	}
+
+	time.Sleep(p.backoff(attempt))
+
+	return true
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempt; i++ {
+		d *= 2
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			return p.MaxBackoff
+		}
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		return p.MaxBackoff
+	}
+
+	return d
+}
+
+// isTransient reports whether the error may not occur if the operation is
+// attempted again.
+func isTransient(err error) bool {
+	switch err.(type) {
+	case r.RQLAvailabilityError, r.RQLOpFailedError, r.RQLOpIndeterminateError,
+		r.RQLConnectionError, r.RQLTimeoutError:
+		return true
+	}
+
+	switch err {
+	case r.ErrConnectionClosed, r.ErrNoConnections, r.ErrQueryTimeout:
+		return true
+	}
+
+	// Errors of individual writes are only reported as a message
+	return strings.HasPrefix(err.Error(), "Cannot perform write")
+}
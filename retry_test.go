@@ -0,0 +1,107 @@
+package regrid
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts: 4,
+		Backoff:     time.Millisecond,
+		MaxBackoff:  3 * time.Millisecond,
+	}
+
+	t.Run("Backoff", func(t *testing.T) {
+		assert.Equal(t, time.Millisecond, policy.backoff(1))
+		assert.Equal(t, 2*time.Millisecond, policy.backoff(2))
+		assert.Equal(t, 3*time.Millisecond, policy.backoff(3))
+		assert.Equal(t, 3*time.Millisecond, policy.backoff(10))
+	})
+
+	t.Run("Transient", func(t *testing.T) {
+		attempts := 0
+		err := policy.do(func() error {
+			attempts++
+			return r.ErrConnectionClosed
+		})
+		assert.Equal(t, r.ErrConnectionClosed, err)
+		assert.Equal(t, 4, attempts)
+
+		attempts = 0
+		err = policy.do(func() error {
+			attempts++
+			if attempts < 3 {
+				return errors.New("Cannot perform write: primary replica for shard [\"\", +inf) not available")
+			}
+			return nil
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, 3, attempts)
+	})
+
+	t.Run("Permanent", func(t *testing.T) {
+		attempts := 0
+		err := policy.do(func() error {
+			attempts++
+			return ErrInvalid
+		})
+		assert.Equal(t, ErrInvalid, err)
+		assert.Equal(t, 1, attempts)
+	})
+}
+
+func TestBucketRetry(t *testing.T) {
+	bucket := New(session, BucketOptions{
+		DatabaseName:   db,
+		BucketName:     "retry",
+		ChunkSizeBytes: 500,
+		Retry: RetryPolicy{
+			MaxAttempts: 3,
+			Backoff:     10 * time.Millisecond,
+		},
+	})
+	require.Nil(t, bucket.Init())
+
+	src, err := ioutil.ReadFile("files/lipsum.txt")
+	require.Nil(t, err)
+
+	dst, err := bucket.Create("/docs/lipsum.txt", nil)
+	require.Nil(t, err)
+	_, err = dst.Write(src)
+	require.Nil(t, err)
+	require.Nil(t, dst.Close())
+
+	t.Run("ChunkID", func(t *testing.T) {
+		cur, err := r.DB(db).Table("retry_chunks").OrderBy("num").Field("id").Run(session)
+		require.Nil(t, err)
+
+		var ids []string
+		require.Nil(t, cur.All(&ids))
+		assert.Equal(t, []string{dst.ID + ":0", dst.ID + ":1", dst.ID + ":2"}, ids)
+	})
+
+	t.Run("Resume", func(t *testing.T) {
+		file, err := bucket.Open("/docs/lipsum.txt")
+		require.Nil(t, err)
+
+		buf := make([]byte, 500)
+		_, err = file.Read(buf)
+		require.Nil(t, err)
+
+		// Replace the cursor as if the connection had failed after the first
+		// chunk was read
+		require.Nil(t, file.cursor.Close())
+		require.Nil(t, file.reopenChunks(r.ErrConnectionClosed))
+
+		rest, err := ioutil.ReadAll(file)
+		require.Nil(t, err)
+		assert.Equal(t, src, append(buf, rest...))
+	})
+}
@@ -0,0 +1,35 @@
+package regrid
+
+import (
+	"context"
+	"log/slog"
+)
+
+// SlogHook logs every query with its duration at debug level, or at error
+// level if the query fails.
+func SlogHook(logger *slog.Logger) QueryHook {
+	return QueryHookFunc(func(ctx context.Context, info QueryInfo, next func(context.Context) error) error {
+		duration, err := timeQuery(ctx, next)
+
+		attrs := []slog.Attr{
+			slog.String("op", info.Op),
+			slog.String("table", info.Table),
+			slog.Duration("duration", duration),
+		}
+		if info.FileID != "" {
+			attrs = append(attrs, slog.String("file_id", info.FileID))
+		}
+		if info.Chunk >= 0 {
+			attrs = append(attrs, slog.Int("chunk", info.Chunk))
+		}
+
+		level := slog.LevelDebug
+		if err != nil {
+			level = slog.LevelError
+			attrs = append(attrs, slog.String("error", err.Error()))
+		}
+		logger.LogAttrs(ctx, level, "regrid query", attrs...)
+
+		return err
+	})
+}
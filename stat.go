@@ -0,0 +1,106 @@
+package regrid
+
+import (
+	"time"
+
+	r "github.com/dancannon/gorethink"
+)
+
+// Stat returns the latest complete revision of the file without fetching its
+// content.
+func (b *Bucket) Stat(filename string) (_ *FileInfo, err error) {
+	defer b.observe("stat", time.Now(), &err)
+
+	fi, err := b.stat(filename)
+	if err != nil {
+		return nil, wrapError("stat", filename, "", err)
+	}
+
+	return fi, nil
+}
+
+func (b *Bucket) stat(filename string) (*FileInfo, error) {
+	fi, err := b.statFirst(b.revisions(filename, r.MaxVal).OrderBy(r.OrderByOpts{
+		Index: r.Desc(fileIndexName),
+	}).Without("data"))
+	if err != nil {
+		return nil, err
+	}
+	if fi == nil {
+		return nil, ErrNotExist
+	}
+
+	return fi, nil
+}
+
+// StatID returns the file with the given ID, whatever its status, without
+// fetching its content.
+func (b *Bucket) StatID(id string) (_ *FileInfo, err error) {
+	defer b.observe("stat", time.Now(), &err)
+
+	fi, err := b.statID(id)
+	if err != nil {
+		return nil, wrapError("stat", "", id, err)
+	}
+
+	return fi, nil
+}
+
+func (b *Bucket) statID(id string) (*FileInfo, error) {
+	fi, err := b.statFirst(b.readTable(b.filesTable).GetAll(id).Without("data"))
+	if err != nil {
+		return nil, err
+	}
+	if fi == nil {
+		return nil, ErrNotExist
+	}
+
+	return fi, nil
+}
+
+// Exists reports whether the file has a complete revision.
+func (b *Bucket) Exists(filename string) (_ bool, err error) {
+	defer b.observe("exists", time.Now(), &err)
+
+	exists, err := b.exists(filename)
+	if err != nil {
+		return false, wrapError("exists", filename, "", err)
+	}
+
+	return exists, nil
+}
+
+func (b *Bucket) exists(filename string) (bool, error) {
+	var exists bool
+	if err := b.revisions(filename, r.MaxVal).IsEmpty().Not().ReadOne(&exists, b.exec("file_exists", b.filesTable, "")); err != nil {
+		return false, err
+	}
+
+	return exists, nil
+}
+
+// statFirst returns the first file selected by the query or nil if the query
+// selects nothing.
+func (b *Bucket) statFirst(query r.Term) (*FileInfo, error) {
+	cur, err := query.Limit(1).Run(b.exec("get_file", b.filesTable, ""))
+	if err != nil {
+		return nil, err
+	}
+
+	var fi *FileInfo
+	found := cur.Next(&fi)
+	if err := cur.Err(); err != nil {
+		cur.Close()
+		return nil, err
+	}
+	if err := cur.Close(); err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, nil
+	}
+
+	fi.bucket = b
+
+	return fi, nil
+}
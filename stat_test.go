@@ -0,0 +1,78 @@
+package regrid
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucketStat(t *testing.T) {
+	bucket := New(session, BucketOptions{
+		DatabaseName: db,
+		BucketName:   "stat",
+	})
+	require.Nil(t, bucket.Init())
+
+	var ids []string
+	for _, content := range []string{"one", "three"} {
+		dst, err := bucket.Create("/docs/document.txt", map[string]interface{}{"kind": "doc"})
+		require.Nil(t, err)
+		_, err = dst.Write([]byte(content))
+		require.Nil(t, err)
+		require.Nil(t, dst.Close())
+		ids = append(ids, dst.ID)
+	}
+
+	t.Run("Stat", func(t *testing.T) {
+		fi, err := bucket.Stat("/docs/document.txt")
+		require.Nil(t, err)
+		assert.Equal(t, ids[1], fi.ID)
+		assert.Equal(t, 5, fi.Length)
+
+		file, err := fi.Open()
+		require.Nil(t, err)
+		assert.Nil(t, file.Close())
+
+		_, err = bucket.Stat("/docs/notfound.txt")
+		assert.True(t, errors.Is(err, ErrNotExist))
+	})
+
+	t.Run("StatID", func(t *testing.T) {
+		fi, err := bucket.StatID(ids[0])
+		require.Nil(t, err)
+		assert.Equal(t, 3, fi.Length)
+
+		_, err = bucket.StatID("notfound")
+		assert.True(t, errors.Is(err, ErrNotExist))
+	})
+
+	t.Run("Exists", func(t *testing.T) {
+		exists, err := bucket.Exists("/docs/document.txt")
+		require.Nil(t, err)
+		assert.True(t, exists)
+
+		exists, err = bucket.Exists("/docs/notfound.txt")
+		require.Nil(t, err)
+		assert.False(t, exists)
+	})
+
+	t.Run("Count", func(t *testing.T) {
+		n, err := bucket.CountFilename("/docs/document.txt")
+		require.Nil(t, err)
+		assert.Equal(t, 2, n)
+
+		n, err = bucket.CountRegex("^/docs")
+		require.Nil(t, err)
+		assert.Equal(t, 2, n)
+
+		n, err = bucket.CountMetadata(map[string]interface{}{"kind": "doc"})
+		require.Nil(t, err)
+		assert.Equal(t, 2, n)
+
+		n, err = bucket.CountRegex("^/images")
+		require.Nil(t, err)
+		assert.Equal(t, 0, n)
+	})
+}
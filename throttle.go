@@ -0,0 +1,106 @@
+package regrid
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter limits the rate at which chunk data is transferred. A Limiter is
+// safe for concurrent use and can be shared by many buckets and files to
+// limit their combined rate.
+type Limiter struct {
+	mu     sync.Mutex
+	bytes  tokenRate
+	chunks tokenRate
+	// now and sleep are replaced by tests to run the limiter on a fake clock
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// NewLimiter returns a Limiter which allows bytesPerSecond bytes and
+// chunksPerSecond chunks to be transferred each second, either limit is
+// disabled when zero. Up to one second's allowance can be used in a burst.
+func NewLimiter(bytesPerSecond, chunksPerSecond int) *Limiter {
+	return &Limiter{
+		bytes:  tokenRate{perSecond: float64(bytesPerSecond)},
+		chunks: tokenRate{perSecond: float64(chunksPerSecond)},
+		now:    time.Now,
+		sleep:  time.Sleep,
+	}
+}
+
+// wait blocks until the transfer of the given number of bytes and chunks is
+// allowed. A nil Limiter does not limit.
+func (l *Limiter) wait(bytes, chunks int) {
+	if l == nil {
+		return
+	}
+
+	if d := l.reserve(l.now(), bytes, chunks); d > 0 {
+		l.sleep(d)
+	}
+}
+
+// reserve takes the tokens for a transfer and returns how long to wait
+// before making it.
+func (l *Limiter) reserve(now time.Time, bytes, chunks int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	d := l.bytes.reserve(now, bytes)
+	if cd := l.chunks.reserve(now, chunks); cd > d {
+		d = cd
+	}
+
+	return d
+}
+
+// tokenRate is a token bucket which allows the balance to go negative, so
+// that transfers larger than the burst are delayed rather than rejected.
+type tokenRate struct {
+	perSecond float64
+	tokens    float64
+	last      time.Time
+}
+
+func (t *tokenRate) reserve(now time.Time, n int) time.Duration {
+	if t.perSecond <= 0 {
+		return 0
+	}
+
+	if t.last.IsZero() {
+		t.tokens = t.perSecond
+	} else if elapsed := now.Sub(t.last); elapsed > 0 {
+		t.tokens += elapsed.Seconds() * t.perSecond
+		if t.tokens > t.perSecond {
+			t.tokens = t.perSecond
+		}
+	}
+	if now.After(t.last) {
+		t.last = now
+	}
+
+	t.tokens -= float64(n)
+	if t.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-t.tokens / t.perSecond * float64(time.Second))
+}
+
+// SetLimiter limits the rate at which this file is read or written, in
+// addition to any limit configured on the bucket.
+func (f *File) SetLimiter(l *Limiter) {
+	f.limiter = l
+}
+
+// throttle waits until the transfer of a chunk of the given size is allowed
+// by the bucket and file limiters.
+func (f *File) throttle(size int) {
+	if f.mode == fileModeWrite {
+		f.bucket.writeLimiter.wait(size, 1)
+	} else {
+		f.bucket.readLimiter.wait(size, 1)
+	}
+	f.limiter.wait(size, 1)
+}
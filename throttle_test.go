@@ -0,0 +1,127 @@
+package regrid
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock stands in for the clock of a Limiter, sleeping advances the time
+// and records how long the limiter waited.
+type fakeClock struct {
+	now    time.Time
+	waited time.Duration
+}
+
+func (c *fakeClock) install(l *Limiter) {
+	l.now = func() time.Time {
+		return c.now
+	}
+	l.sleep = func(d time.Duration) {
+		c.now = c.now.Add(d)
+		c.waited += d
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	now := time.Now()
+
+	t.Run("Bytes", func(t *testing.T) {
+		l := NewLimiter(1000, 0)
+		assert.Equal(t, time.Duration(0), l.reserve(now, 1000, 1))
+		assert.Equal(t, 500*time.Millisecond, l.reserve(now, 500, 1))
+		// The debt is repaid over time
+		assert.Equal(t, 100*time.Millisecond, l.reserve(now.Add(500*time.Millisecond), 100, 1))
+	})
+
+	t.Run("Chunks", func(t *testing.T) {
+		l := NewLimiter(0, 2)
+		assert.Equal(t, time.Duration(0), l.reserve(now, 1<<20, 2))
+		assert.Equal(t, 500*time.Millisecond, l.reserve(now, 1<<20, 1))
+	})
+
+	t.Run("Burst", func(t *testing.T) {
+		// Idle time only accumulates up to one second's allowance
+		l := NewLimiter(0, 10)
+		assert.Equal(t, time.Duration(0), l.reserve(now, 0, 10))
+		later := now.Add(time.Minute)
+		assert.Equal(t, time.Duration(0), l.reserve(later, 0, 10))
+		assert.Equal(t, 100*time.Millisecond, l.reserve(later, 0, 1))
+	})
+
+	t.Run("Both", func(t *testing.T) {
+		// The transfer waits for the stricter of the two limits
+		l := NewLimiter(100, 10)
+		assert.Equal(t, time.Duration(0), l.reserve(now, 100, 1))
+		assert.Equal(t, 500*time.Millisecond, l.reserve(now, 50, 1))
+		assert.Equal(t, 500*time.Millisecond, l.reserve(now.Add(time.Second), 0, 15))
+	})
+
+	t.Run("ClockSkew", func(t *testing.T) {
+		// A clock going backwards does not add tokens or move the limiter back
+		l := NewLimiter(0, 10)
+		assert.Equal(t, time.Duration(0), l.reserve(now, 0, 10))
+		assert.Equal(t, 100*time.Millisecond, l.reserve(now.Add(-time.Second), 0, 1))
+		assert.Equal(t, 100*time.Millisecond, l.reserve(now.Add(100*time.Millisecond), 0, 1))
+	})
+
+	t.Run("Wait", func(t *testing.T) {
+		l := NewLimiter(0, 10)
+		clock := &fakeClock{now: now}
+		clock.install(l)
+
+		for i := 0; i < 15; i++ {
+			l.wait(100, 1)
+		}
+		assert.Equal(t, 500*time.Millisecond, clock.waited)
+	})
+
+	t.Run("Nil", func(t *testing.T) {
+		var l *Limiter
+		l.wait(1<<20, 1)
+	})
+}
+
+func TestBucketThrottle(t *testing.T) {
+	limiter := NewLimiter(0, 10)
+	clock := &fakeClock{now: time.Now()}
+	clock.install(limiter)
+	bucket := New(session, BucketOptions{
+		DatabaseName:   db,
+		BucketName:     "throttle",
+		ChunkSizeBytes: 100,
+		ReadLimiter:    limiter,
+		WriteLimiter:   limiter,
+	})
+	require.Nil(t, bucket.Init())
+
+	src, err := ioutil.ReadFile("files/lipsum.txt")
+	require.Nil(t, err)
+
+	// 15 chunks at 10 chunks per second with a burst of 10
+	dst, err := bucket.Create("/docs/lipsum.txt", nil)
+	require.Nil(t, err)
+	_, err = dst.Write(src)
+	require.Nil(t, err)
+	require.Nil(t, dst.Close())
+	assert.InDelta(t, 500*time.Millisecond, clock.waited, float64(time.Millisecond))
+
+	// Reading shares the limiter so every chunk waits, the file limiter is
+	// consulted as well
+	clock.waited = 0
+	fileLimiter := NewLimiter(0, 5)
+	fileClock := &fakeClock{now: clock.now}
+	fileClock.install(fileLimiter)
+
+	file, err := bucket.Open("/docs/lipsum.txt")
+	require.Nil(t, err)
+	file.SetLimiter(fileLimiter)
+	data, err := ioutil.ReadAll(file)
+	require.Nil(t, err)
+	assert.Equal(t, src, data)
+	assert.InDelta(t, 1500*time.Millisecond, clock.waited, float64(time.Millisecond))
+	assert.InDelta(t, 2000*time.Millisecond, fileClock.waited, float64(time.Millisecond))
+}
@@ -0,0 +1,107 @@
+package regrid
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Tracer starts spans, it mirrors the subset of the OpenTelemetry tracing API
+// used by TracingHook so an OpenTelemetry tracer can be adapted with a thin
+// wrapper.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a single traced query.
+type Span interface {
+	SetAttribute(key string, value interface{})
+	RecordError(err error)
+	End()
+}
+
+// TracingHook records a span named "regrid.<op>" for every query.
+func TracingHook(tracer Tracer) QueryHook {
+	return QueryHookFunc(func(ctx context.Context, info QueryInfo, next func(context.Context) error) error {
+		ctx, span := tracer.Start(ctx, "regrid."+info.Op)
+		defer span.End()
+
+		span.SetAttribute("db.operation", info.Op)
+		span.SetAttribute("db.sql.table", info.Table)
+		if info.FileID != "" {
+			span.SetAttribute("regrid.file_id", info.FileID)
+		}
+		if info.Chunk >= 0 {
+			span.SetAttribute("regrid.chunk", info.Chunk)
+		}
+
+		err := next(ctx)
+		if err != nil {
+			span.RecordError(err)
+		}
+
+		return err
+	})
+}
+
+// SpanRecorder is a Tracer which keeps finished spans in memory, for tests.
+type SpanRecorder struct {
+	mu    sync.Mutex
+	spans []*RecordedSpan
+}
+
+type RecordedSpan struct {
+	Name               string
+	Attributes         map[string]interface{}
+	Err                error
+	StartTime, EndTime time.Time
+}
+
+func (rec *SpanRecorder) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, &recordingSpan{
+		recorder: rec,
+		span: &RecordedSpan{
+			Name:       name,
+			Attributes: map[string]interface{}{},
+			StartTime:  time.Now(),
+		},
+	}
+}
+
+// Spans returns the spans which have ended, in the order they ended.
+func (rec *SpanRecorder) Spans() []*RecordedSpan {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	return append([]*RecordedSpan(nil), rec.spans...)
+}
+
+// Reset discards the recorded spans.
+func (rec *SpanRecorder) Reset() {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	rec.spans = nil
+}
+
+type recordingSpan struct {
+	recorder *SpanRecorder
+	span     *RecordedSpan
+}
+
+func (s *recordingSpan) SetAttribute(key string, value interface{}) {
+	s.span.Attributes[key] = value
+}
+
+func (s *recordingSpan) RecordError(err error) {
+	s.span.Err = err
+}
+
+func (s *recordingSpan) End() {
+	s.span.EndTime = time.Now()
+
+	s.recorder.mu.Lock()
+	defer s.recorder.mu.Unlock()
+
+	s.recorder.spans = append(s.recorder.spans, s.span)
+}
@@ -1,18 +1,42 @@
 package regrid
 
 import (
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"hash"
+	"hash/crc32"
+	"strconv"
 	"time"
 
 	r "github.com/dancannon/gorethink"
 )
 
 var (
-	ErrInvalid          = errors.New("invalid argument")
-	ErrNotExist         = errors.New("file does not exist")
-	ErrRevisionNotExist = errors.New("revision does not exist")
-	ErrHashMismatch     = errors.New("sha256 hash mismatch")
+	ErrInvalid            = errors.New("invalid argument")
+	ErrNotInitialized     = errors.New("bucket not initialized")
+	ErrConfigMismatch     = errors.New("bucket options do not match stored configuration")
+	ErrUnsupportedVersion = errors.New("bucket layout version not supported")
+	ErrOutdatedLayout     = errors.New("bucket layout outdated")
+	ErrExist              = errors.New("file already exists")
+	ErrNotExist           = errors.New("file does not exist")
+	ErrRevisionNotExist   = errors.New("revision does not exist")
+	ErrHashMismatch       = errors.New("hash mismatch")
+	ErrLengthMismatch     = errors.New("length mismatch")
+	ErrChecksumMismatch   = errors.New("chunk checksum mismatch")
+	ErrClosed             = errors.New("file already closed")
+	ErrReadOnly           = errors.New("file not open for writing")
+
+	ErrPreconditionFailed = errors.New("precondition failed")
+	ErrLeaseHeld          = errors.New("lease held by another owner")
+	ErrLeaseNotHeld       = errors.New("lease not held")
+
+	ErrDedupeDisabled = errors.New("chunk dedupe not enabled")
+
+	ErrNoKeyProvider    = errors.New("no key provider configured")
+	ErrKeyNotFound      = errors.New("encryption key not found")
+	ErrDecryptionFailed = errors.New("chunk decryption failed")
 )
 
 type Status string
@@ -27,52 +51,139 @@ const (
 type FileInfo struct {
 	bucket *Bucket
 
-	ID         string                 `gorethink:"id,omitempty"`
-	Filename   string                 `gorethink:"filename"`
-	Status     Status                 `gorethink:"status"`
-	Length     int                    `gorethink:"length"`
-	ChunkSize  int                    `gorethink:"chunkSize"`
-	FinishedAt time.Time              `gorethink:"finishedAt"`
-	StartedAt  time.Time              `gorethink:"startedAt"`
-	DeletedAt  time.Time              `gorethink:"deletedAt"`
-	Sha256     string                 `gorethink:"sha256"`
-	Metadata   map[string]interface{} `gorethink:"metadata"`
+	ID           string                 `gorethink:"id,omitempty"`
+	Filename     string                 `gorethink:"filename"`
+	Status       Status                 `gorethink:"status"`
+	Length       int                    `gorethink:"length"`
+	ChunkSize    int                    `gorethink:"chunkSize"`
+	Chunking     Chunking               `gorethink:"chunking,omitempty"`
+	MinChunkSize int                    `gorethink:"minChunkSize,omitempty"`
+	MaxChunkSize int                    `gorethink:"maxChunkSize,omitempty"`
+	ContentType  string                 `gorethink:"contentType,omitempty"`
+	Compression  Compression            `gorethink:"compression,omitempty"`
+	KeyID        string                 `gorethink:"keyId,omitempty"`
+	Encrypting   bool                   `gorethink:"encrypting,omitempty"`
+	Dedupe       bool                   `gorethink:"dedupe,omitempty"`
+	Revision     int                    `gorethink:"revision,omitempty"`
+	DataID       string                 `gorethink:"dataId,omitempty"`
+	Inline       bool                   `gorethink:"inline,omitempty"`
+	InlineData   []byte                 `gorethink:"data,omitempty"`
+	FinishedAt   time.Time              `gorethink:"finishedAt"`
+	StartedAt    time.Time              `gorethink:"startedAt"`
+	DeletedAt    time.Time              `gorethink:"deletedAt"`
+	Sha256       string                 `gorethink:"sha256"`
+	Hashes       map[string]string      `gorethink:"hashes,omitempty"`
+	Metadata     map[string]interface{} `gorethink:"metadata"`
+}
+
+// chunksID returns the ID of the file which owns the chunks of this file,
+// files deduplicated by hash share the chunks of an earlier file.
+func (fi *FileInfo) chunksID() string {
+	if fi.DataID != "" {
+		return fi.DataID
+	}
+
+	return fi.ID
 }
 
 func (fi *FileInfo) Open() (*File, error) {
 	f := &File{
 		FileInfo: fi,
 		bucket:   fi.bucket,
+		mode:     fileModeRead,
 	}
 	if err := f.open(); err != nil {
-		return nil, err
+		return nil, wrapError("open", fi.Filename, fi.ID, err)
 	}
 
 	return f, nil
 }
 
+// fileMode is the direction a File was opened in, files decoded from the
+// database are read handles.
+type fileMode int
+
+const (
+	fileModeRead fileMode = iota
+	fileModeWrite
+)
+
 type File struct {
 	*FileInfo
 
 	// Internal fields used for both reading/writing
-	bucket *Bucket
-	hash   hash.Hash
+	bucket    *Bucket
+	mode      fileMode
+	closed    bool
+	hash      hash.Hash
+	hashes    map[HashAlgorithm]hash.Hash
+	aeads     map[string]cipher.AEAD
+	limiter   *Limiter
+	callbacks Callbacks
+	// transferred counts the bytes of content read or written and done is
+	// set once the transfer has completed or failed
+	transferred int
+	done        bool
 
 	// Internal fields used for reading
-	cursor *r.Cursor
-	buf    []byte
-	opened bool
+	cursor   *r.Cursor
+	buf      []byte
+	opened   bool
+	next     int
+	attempts int
+
+	// Internal fields used for writing, closing is set once Close has been
+	// called and flushed once all the content has been written and hashed
+	closing        bool
+	flushed        bool
+	num            int
+	cdc            *fastCDC
+	pending        []byte
+	inlineLimit    int
+	inlineBuf      []byte
+	precondition   precondition
+	expectedLength *int
+	expectedSha256 string
+	durability     Durability
+}
+
+// Close finishes reading or writing the file. Closing a file more than once
+// has no effect. A file being read is closed even if Close returns an error,
+// while closing an upload can be retried until the file is complete or has
+// been rejected, no more content can be written once Close has been called.
+func (f *File) Close() (err error) {
+	if f == nil || f.bucket == nil {
+		return ErrInvalid
+	}
+	if f.closed {
+		return nil
+	}
+	defer f.observe("close", time.Now(), &err)
+
+	if f.mode == fileModeWrite {
+		f.closing = true
+		err := f.closeWrite()
+		if err == nil || rejected(err) {
+			f.closed = true
+			f.reportDone(err)
+		}
+		return wrapError("close", f.Filename, f.ID, err)
+	}
 
-	// Internal fields used for writing
-	num int
+	f.closed = true
+	return wrapError("close", f.Filename, f.ID, f.closeRead())
 }
 
-func (f *File) Close() error {
-	if f.Status == StatusIncomplete {
-		return f.closeWrite()
-	} else {
-		return f.closeRead()
+// rejected reports whether closing an upload failed because the file was
+// rejected and deleted, rather than because of an error which may be
+// transient.
+func rejected(err error) bool {
+	switch err {
+	case ErrLengthMismatch, ErrHashMismatch, ErrPreconditionFailed, ErrLeaseNotHeld:
+		return true
 	}
+
+	return false
 }
 
 type Chunk struct {
@@ -80,8 +191,34 @@ type Chunk struct {
 	FileID string `gorethink:"file_id"`
 	Num    int    `gorethink:"num"`
 	Data   []byte `gorethink:"data"`
+	Nonce  []byte `gorethink:"nonce,omitempty"`
+	KeyID  string `gorethink:"keyId,omitempty"`
+	BlobID string `gorethink:"blobId,omitempty"`
+	// Checksum is the hex encoded CRC-32C of Data as stored, after any
+	// compression or encryption.
+	Checksum string `gorethink:"checksum,omitempty"`
+}
+
+func chunkID(fileID string, num int) string {
+	return fileID + ":" + strconv.Itoa(num)
+}
+
+func (c *Chunk) verify(fileID string) error {
+	if c.Checksum != "" && c.Checksum != chunkChecksum(c.Data) {
+		return &ChunkError{FileID: fileID, Num: c.Num, Err: ErrChecksumMismatch}
+	}
+
+	return nil
 }
 
+func chunkChecksum(data []byte) string {
+	sum := make([]byte, 4)
+	binary.BigEndian.PutUint32(sum, crc32.Checksum(data, castagnoli))
+	return hex.EncodeToString(sum)
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
 type FileInfoChange struct {
 	NewVal *FileInfo `gorethink:"new_val"`
 	OldVal *FileInfo `gorethink:"old_val"`
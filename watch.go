@@ -3,24 +3,51 @@ package regrid
 import r "github.com/dancannon/gorethink"
 
 func (b *Bucket) WatchRegex(pattern string) (*r.Cursor, error) {
+	cursor, err := b.watchRegex(pattern)
+	if err != nil {
+		return nil, wrapError("watch", "", "", err)
+	}
+
+	return cursor, nil
+}
+
+func (b *Bucket) watchRegex(pattern string) (*r.Cursor, error) {
 	return r.DB(b.databaseName).Table(b.filesTable).Filter(r.And(
 		r.Row.Field("status").Eq(StatusComplete),
 		r.Row.Field("filename").Match(pattern),
-	)).Changes().Run(b.session)
+	)).Changes().Run(b.exec("watch_files", b.filesTable, ""))
 }
 
 func (b *Bucket) WatchFilename(filename string) (*r.Cursor, error) {
+	cursor, err := b.watchFilename(filename)
+	if err != nil {
+		return nil, wrapError("watch", filename, "", err)
+	}
+
+	return cursor, nil
+}
+
+func (b *Bucket) watchFilename(filename string) (*r.Cursor, error) {
 	return r.DB(b.databaseName).Table(b.filesTable).Between(
 		[]interface{}{StatusComplete, filename, r.MinVal},
 		[]interface{}{StatusComplete, filename, r.MaxVal},
 	).OptArgs(r.BetweenOpts{
 		Index: fileIndexName,
-	}).Changes().Run(b.session)
+	}).Changes().Run(b.exec("watch_files", b.filesTable, ""))
 }
 
 func (b *Bucket) WatchMetadata(metadata map[string]interface{}) (*r.Cursor, error) {
+	cursor, err := b.watchMetadata(metadata)
+	if err != nil {
+		return nil, wrapError("watch", "", "", err)
+	}
+
+	return cursor, nil
+}
+
+func (b *Bucket) watchMetadata(metadata map[string]interface{}) (*r.Cursor, error) {
 	return r.DB(b.databaseName).Table(b.filesTable).Filter(r.And(
 		r.Row.Field("status").Eq(StatusComplete),
 		r.Row.Field("metadata").Eq(metadata),
-	)).Changes().Run(b.session)
+	)).Changes().Run(b.exec("watch_files", b.filesTable, ""))
 }
@@ -1,37 +1,273 @@
 package regrid
 
 import (
-	"encoding/hex"
 	"fmt"
 	"io"
+	"strings"
 	"time"
 
 	r "github.com/dancannon/gorethink"
 )
 
+const preconditionFailedMessage = "regrid: precondition failed"
+
+type CreateOptions struct {
+	Metadata map[string]interface{}
+
+	// ID is used as the ID of the new file instead of one generated by
+	// RethinkDB, if GenerateID is set then it is called to create the ID.
+	ID         string
+	GenerateID func() (string, error)
+	// ChunkSizeBytes overrides the chunk size of the bucket for this file.
+	ChunkSizeBytes int
+	ContentType    string
+	// Compression overrides the compression of the bucket for this file.
+	Compression Compression
+
+	// ExpectedLength and ExpectedSha256 reject the file when it is closed if
+	// the written content does not match, nil and empty values disable the
+	// checks. A pointer to zero expects an empty file.
+	ExpectedLength *int
+	ExpectedSha256 string
+
+	// IfNotExist rejects the upload with ErrPreconditionFailed if a complete
+	// revision of the filename exists.
+	IfNotExist bool
+	// IfLatestID rejects the upload with ErrPreconditionFailed unless the
+	// latest complete revision of the filename has this ID.
+	IfLatestID string
+	// Lease rejects the upload with ErrLeaseNotHeld unless the lease on the
+	// filename is still held when the file is created and completed.
+	Lease *Lease
+	// Durability overrides the durability of the tables for the writes of
+	// this upload.
+	Durability Durability
+	// Callbacks are notified of the progress of the upload.
+	Callbacks Callbacks
+}
+
+type precondition struct {
+	ifNotExist bool
+	ifLatestID string
+	lease      *Lease
+}
+
+func (p precondition) isSet() bool {
+	return p.ifNotExist || p.ifLatestID != "" || p.lease != nil
+}
+
+// revisionTerm builds a ReQL expression which evaluates to true if the
+// precondition holds for the ID of the latest revision (or nil if there is no
+// revision).
+func (p precondition) revisionTerm(latest r.Term) r.Term {
+	if p.ifNotExist {
+		return latest.Eq(nil)
+	}
+	if p.ifLatestID != "" {
+		return latest.Eq(p.ifLatestID)
+	}
+
+	return r.Expr(true)
+}
+
+func (p precondition) leaseTerm() r.Term {
+	if p.lease == nil {
+		return r.Expr(true)
+	}
+
+	return p.lease.heldTerm()
+}
+
+func (p precondition) check(b *Bucket, filename string) error {
+	var res struct {
+		Lease    bool `gorethink:"lease"`
+		Revision bool `gorethink:"revision"`
+	}
+	if err := r.Expr(map[string]interface{}{
+		"lease":    p.leaseTerm(),
+		"revision": p.revisionTerm(b.headLatest(filename)),
+	}).ReadOne(&res, b.exec("check_precondition", b.filesTable, "")); err != nil {
+		return err
+	}
+
+	if !res.Lease {
+		return ErrLeaseNotHeld
+	}
+	if !res.Revision {
+		return ErrPreconditionFailed
+	}
+
+	return nil
+}
+
+// checkLease returns ErrLeaseNotHeld if the precondition has a lease which is
+// no longer held.
+func (p precondition) checkLease(b *Bucket) error {
+	if p.lease == nil {
+		return nil
+	}
+
+	var held bool
+	if err := p.leaseTerm().ReadOne(&held, b.exec("check_lease", b.leasesTable, "")); err != nil {
+		return err
+	}
+	if !held {
+		return ErrLeaseNotHeld
+	}
+
+	return nil
+}
+
 func (b *Bucket) Create(filename string, metadata map[string]interface{}) (*File, error) {
+	return b.CreateWithOptions(filename, CreateOptions{
+		Metadata: metadata,
+	})
+}
+
+// CreateWithOptions creates a new revision of the file. Any preconditions are
+// checked when the file is created and again when it is closed, when the
+// revision preconditions are enforced atomically against other uploads of the
+// filename.
+func (b *Bucket) CreateWithOptions(filename string, options CreateOptions) (_ *File, err error) {
+	defer b.observe("create", time.Now(), &err)
+
+	f, err := b.createWithOptions(filename, options)
+	if err != nil {
+		return nil, wrapError("create", filename, "", err)
+	}
+
+	return f, nil
+}
+
+func (b *Bucket) createWithOptions(filename string, options CreateOptions) (*File, error) {
+	if options.IfNotExist && options.IfLatestID != "" {
+		return nil, ErrInvalid
+	}
+
+	if options.Lease != nil && options.Lease.Filename != filename {
+		return nil, ErrInvalid
+	}
+	if options.ChunkSizeBytes < 0 || (options.ExpectedLength != nil && *options.ExpectedLength < 0) || !options.Durability.valid() {
+		return nil, ErrInvalid
+	}
+	for _, algorithm := range b.hashes {
+		if _, err := newHash(algorithm); err != nil {
+			return nil, err
+		}
+	}
+	if err := b.ensureConfig(); err != nil {
+		return nil, err
+	}
+
+	id := options.ID
+	if options.GenerateID != nil {
+		if id != "" {
+			return nil, ErrInvalid
+		}
+
+		var err error
+		if id, err = options.GenerateID(); err != nil {
+			return nil, err
+		}
+	}
+
+	chunkSize := options.ChunkSizeBytes
+	if chunkSize == 0 {
+		chunkSize = b.chunkSizeBytes
+	}
+
+	if !b.chunking.valid() {
+		return nil, ErrInvalid
+	}
+	var cdc *fastCDC
+	if b.chunking == ChunkingFastCDC {
+		min, max := b.minChunkSizeBytes, b.maxChunkSizeBytes
+		if min == 0 {
+			min = chunkSize / 4
+		}
+		if max == 0 {
+			max = chunkSize * 4
+		}
+
+		var err error
+		if cdc, err = newFastCDC(min, chunkSize, max); err != nil {
+			return nil, err
+		}
+	}
+
+	compression := options.Compression
+	if compression == CompressionDefault {
+		compression = b.compression
+	}
+	if !compression.valid() {
+		return nil, ErrInvalid
+	}
+	if compression == CompressionNone {
+		compression = CompressionDefault
+	}
+
+	cond := precondition{
+		ifNotExist: options.IfNotExist,
+		ifLatestID: options.IfLatestID,
+		lease:      options.Lease,
+	}
+	if cond.isSet() {
+		if err := cond.check(b, filename); err != nil {
+			return nil, err
+		}
+	}
+
+	if b.dedupeChunks && b.keyProvider != nil {
+		return nil, ErrInvalid
+	}
+
+	var keyID string
+	if b.keyProvider != nil {
+		var err error
+		if keyID, _, err = b.keyProvider.CurrentKey(); err != nil {
+			return nil, err
+		}
+	}
+
 	newFile := &FileInfo{
-		Filename:  filename,
-		ChunkSize: b.chunkSizeBytes,
-		StartedAt: time.Now(),
-		Status:    StatusIncomplete,
-		Metadata:  metadata,
+		ID:          id,
+		Filename:    filename,
+		ChunkSize:   chunkSize,
+		Chunking:    b.chunking,
+		StartedAt:   time.Now(),
+		Status:      StatusIncomplete,
+		ContentType: options.ContentType,
+		Compression: compression,
+		KeyID:       keyID,
+		Dedupe:      b.dedupeChunks,
+		Metadata:    options.Metadata,
+	}
+
+	if cdc != nil {
+		newFile.MinChunkSize = cdc.min
+		newFile.MaxChunkSize = cdc.max
 	}
 
 	cur, err := r.DB(b.databaseName).Table(b.filesTable).Insert(newFile).OptArgs(r.InsertOpts{
 		ReturnChanges: true,
-	}).Run(b.session)
+		Durability:    durability(options.Durability),
+	}).Run(b.exec("insert_file", b.filesTable, id))
 	if err != nil {
 		return nil, err
 	}
 
 	var rsp struct {
-		Changes []FileInfoChange
+		Changes    []FileInfoChange
+		FirstError string `gorethink:"first_error"`
 	}
 	if err := cur.One(&rsp); err != nil {
 		return nil, err
 	}
 
+	if strings.HasPrefix(rsp.FirstError, "Duplicate primary key") {
+		return nil, ErrExist
+	}
+
 	if len(rsp.Changes) != 1 {
 		return nil, fmt.Errorf("Error opening file for writing")
 	}
@@ -39,13 +275,39 @@ func (b *Bucket) Create(filename string, metadata map[string]interface{}) (*File
 	fileInfo := rsp.Changes[0].NewVal
 	fileInfo.bucket = b
 
-	return fileInfo.Open()
+	f := &File{
+		FileInfo: fileInfo,
+		bucket:   b,
+		mode:     fileModeWrite,
+	}
+	if err := f.resetHashes(b.hashes); err != nil {
+		return nil, err
+	}
+	f.precondition = cond
+	f.cdc = cdc
+	if b.keyProvider == nil {
+		f.inlineLimit = b.inlineThresholdBytes
+	}
+	f.expectedLength = options.ExpectedLength
+	f.expectedSha256 = options.ExpectedSha256
+	f.durability = options.Durability
+	f.callbacks = options.Callbacks
+
+	return f, nil
 }
 
 func (f *File) Write(b []byte) (n int, err error) {
-	if f == nil {
+	if f == nil || f.bucket == nil {
 		return 0, ErrInvalid
 	}
+	defer f.observe("write", time.Now(), &err)
+
+	if f.closed || f.closing {
+		return 0, wrapError("write", f.Filename, f.ID, ErrClosed)
+	}
+	if f.mode != fileModeWrite || f.Status != StatusIncomplete {
+		return 0, wrapError("write", f.Filename, f.ID, ErrReadOnly)
+	}
 	n, err = f.write(b)
 	if n < 0 {
 		n = 0
@@ -53,25 +315,151 @@ func (f *File) Write(b []byte) (n int, err error) {
 	if n != len(b) {
 		err = io.ErrShortWrite
 	}
+	if err != nil {
+		err = wrapError("write", f.Filename, f.ID, err)
+		f.reportDone(err)
+	}
 	return n, err
 }
 
+// closeWrite completes the file. Each step can be repeated after a failure,
+// so that a Close which fails can be retried.
 func (f *File) closeWrite() error {
-	return r.DB(f.bucket.databaseName).Table(f.bucket.filesTable).Get(f.ID).Update(map[string]interface{}{
+	inline := f.inlineLimit > 0
+	if !f.flushed {
+		if err := f.flush(); err != nil {
+			return err
+		}
+		if inline {
+			f.Length = len(f.inlineBuf)
+			f.writeHashes(f.inlineBuf)
+			f.transferred = len(f.inlineBuf)
+			f.bucket.metrics.AddWritten(len(f.inlineBuf), 0)
+			if len(f.inlineBuf) > 0 {
+				f.reportProgress(0)
+			}
+		}
+		f.flushed = true
+	}
+
+	sums := f.sumHashes()
+	sha256 := sums[string(HashSha256)]
+
+	var verr error
+	if f.expectedLength != nil && *f.expectedLength != f.Length {
+		verr = ErrLengthMismatch
+	} else if f.expectedSha256 != "" && !strings.EqualFold(f.expectedSha256, sha256) {
+		verr = ErrHashMismatch
+		f.bucket.metrics.HashMismatch()
+	}
+	if verr != nil {
+		if err := f.bucket.hardDelete(f.ID); err != nil {
+			return err
+		}
+		return verr
+	}
+
+	update := map[string]interface{}{
 		"finishedAt": time.Now(),
 		"status":     StatusComplete,
-		"sha256":     hex.EncodeToString(f.hash.Sum(nil)),
+		"sha256":     sha256,
+		"hashes":     sums,
 		"length":     f.Length,
-	}).Exec(f.bucket.session)
+	}
+	if inline {
+		update["inline"] = true
+		if len(f.inlineBuf) > 0 {
+			update["data"] = f.inlineBuf
+		}
+	}
+
+	var duplicate *FileInfo
+	if f.bucket.dedupeFiles && !inline {
+		var err error
+		if duplicate, err = f.bucket.findDuplicate(f.ID, sha256, f.Length); err != nil {
+			return err
+		}
+	}
+	if duplicate != nil {
+		for k, v := range duplicate.chunkFields() {
+			update[k] = v
+		}
+	}
+
+	if f.Status != StatusComplete {
+		if err := f.complete(update); err != nil {
+			return err
+		}
+		f.Status = StatusComplete
+		f.FinishedAt = update["finishedAt"].(time.Time)
+		f.Sha256 = sha256
+		f.Hashes = sums
+	}
+
+	if duplicate != nil {
+		f.DataID = duplicate.chunksID()
+		return f.bucket.deleteChunks(f.ID, f.Dedupe)
+	}
+
+	return nil
+}
+
+// complete advances the head of the filename to the file, checking the
+// precondition, and then marks the file as complete with the revision number
+// assigned by the head. A file which fails the precondition is deleted.
+func (f *File) complete(update map[string]interface{}) error {
+	var revision int
+	err := f.precondition.checkLease(f.bucket)
+	if err == nil {
+		revision, err = f.bucket.advanceHead(f)
+	}
+	if err == ErrPreconditionFailed || err == ErrLeaseNotHeld {
+		if err := f.bucket.hardDelete(f.ID); err != nil {
+			return err
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	update["revision"] = revision
+	if err := r.DB(f.bucket.databaseName).Table(f.bucket.filesTable).Get(f.ID).Update(update, r.UpdateOpts{
+		Durability: durability(f.durability),
+	}).Exec(f.bucket.exec("complete_file", f.bucket.filesTable, f.ID)); err != nil {
+		return err
+	}
+	f.Revision = revision
+
+	return nil
 }
 
 func (f *File) write(b []byte) (n int, err error) {
+	if f.inlineLimit > 0 {
+		if len(f.inlineBuf)+len(b) <= f.inlineLimit {
+			f.inlineBuf = append(f.inlineBuf, b...)
+			return len(b), nil
+		}
+
+		// The file is too large to be stored inline so write out the data
+		// buffered so far as chunks
+		buffered := f.inlineBuf
+		f.inlineLimit, f.inlineBuf = 0, nil
+		if _, err := f.write(buffered); err != nil {
+			return 0, err
+		}
+	}
+
+	if f.cdc != nil {
+		return f.writeCDC(b)
+	}
+
 	for {
 		bcap := b
-		if len(bcap) > f.bucket.chunkSizeBytes {
-			bcap = bcap[:f.bucket.chunkSizeBytes]
+		if len(bcap) > f.ChunkSize {
+			bcap = bcap[:f.ChunkSize]
 		}
-		m, err := f.writeChunk(b)
+		m, err := f.writeChunk(bcap)
 		n += m
 
 		// If the chunk was partially written then assume it stopped early for
@@ -90,20 +478,87 @@ func (f *File) write(b []byte) (n int, err error) {
 	}
 }
 
+// writeCDC buffers the data until the next chunk boundary can be found,
+// boundaries must not depend on how the caller splits up writes.
+func (f *File) writeCDC(b []byte) (n int, err error) {
+	f.pending = append(f.pending, b...)
+	for len(f.pending) >= f.cdc.max {
+		if err := f.writePending(); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+func (f *File) flush() error {
+	for len(f.pending) > 0 {
+		if err := f.writePending(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *File) writePending() error {
+	n := f.cdc.cut(f.pending)
+	if _, err := f.writeChunk(f.pending[:n]); err != nil {
+		return err
+	}
+	f.pending = append(f.pending[:0], f.pending[n:]...)
+
+	return nil
+}
+
 func (f *File) writeChunk(b []byte) (n int, err error) {
-	if err := r.DB(f.bucket.databaseName).Table(f.bucket.chunksTable).Insert(Chunk{
+	data, err := compressChunk(f.Compression, b)
+	if err != nil {
+		return 0, err
+	}
+
+	chunk := Chunk{
 		FileID: f.ID,
 		Num:    f.num,
-		Data:   b,
-	}).Exec(f.bucket.session); err != nil {
+		Data:   data,
+	}
+	if f.KeyID != "" {
+		chunk.KeyID = f.KeyID
+		if chunk.Data, chunk.Nonce, err = f.encryptChunk(f.KeyID, f.num, data); err != nil {
+			return 0, err
+		}
+	}
+	chunk.Checksum = chunkChecksum(chunk.Data)
+	f.throttle(len(chunk.Data))
+	if f.Dedupe {
+		chunk.BlobID = blobID(data)
+		chunk.Data = nil
+	}
+
+	// The chunk ID is derived from its position so that an insert which may
+	// have been applied before failing can be repeated
+	chunk.ID = chunkID(f.ID, f.num)
+	if err := f.bucket.retry.do(func() error {
+		_, err := r.DB(f.bucket.databaseName).Table(f.bucket.chunksTable).Insert(chunk, r.InsertOpts{
+			Durability: durability(f.durability),
+			Conflict:   "replace",
+		}).RunWrite(f.bucket.execChunk("insert_chunk", f.ID, chunk.Num))
+		return err
+	}); err != nil {
 		return 0, err
 	}
+	if f.Dedupe {
+		if err := f.bucket.storeBlob(data, f.durability); err != nil {
+			return 0, err
+		}
+	}
 
 	f.num++
 	f.Length += len(b)
-	if _, err = f.hash.Write(b); err != nil {
-		return 0, err
-	}
+	f.writeHashes(b)
+	f.transferred += len(b)
+	f.bucket.metrics.AddWritten(len(b), 1)
+	f.reportProgress(chunk.Num)
 
 	return len(b), nil
 }
@@ -1,8 +1,12 @@
 package regrid
 
 import (
+	"context"
+	"errors"
 	"io"
+	"io/ioutil"
 	"os"
+	"sync"
 	"testing"
 
 	r "github.com/dancannon/gorethink"
@@ -81,3 +85,293 @@ func TestBucketCreate(t *testing.T) {
 		})
 	})
 }
+
+func TestBucketCreateWithOptions(t *testing.T) {
+	bucket := New(session, BucketOptions{
+		DatabaseName: db,
+		BucketName:   "write_options",
+	})
+	require.Nil(t, bucket.Init())
+
+	upload := func(options CreateOptions) (*File, error) {
+		dst, err := bucket.CreateWithOptions("/docs/lipsum.txt", options)
+		if err != nil {
+			return nil, err
+		}
+
+		src, err := os.Open("files/lipsum.txt")
+		require.Nil(t, err)
+		defer src.Close()
+
+		_, err = io.Copy(dst, src)
+		require.Nil(t, err)
+
+		return dst, dst.Close()
+	}
+
+	t.Run("IfNotExist", func(t *testing.T) {
+		first, err := upload(CreateOptions{IfNotExist: true})
+		require.Nil(t, err)
+
+		_, err = upload(CreateOptions{IfNotExist: true})
+		assert.True(t, errors.Is(err, ErrPreconditionFailed))
+
+		file, err := bucket.Open("/docs/lipsum.txt")
+		require.Nil(t, err)
+		assert.Equal(t, first.ID, file.ID)
+	})
+
+	t.Run("IfNotExistOnClose", func(t *testing.T) {
+		dst, err := bucket.CreateWithOptions("/docs/race.txt", CreateOptions{IfNotExist: true})
+		require.Nil(t, err)
+
+		other, err := bucket.Create("/docs/race.txt", nil)
+		require.Nil(t, err)
+		require.Nil(t, other.Close())
+
+		assert.True(t, errors.Is(dst.Close(), ErrPreconditionFailed))
+
+		_, err = bucket.OpenID(dst.ID)
+		assert.True(t, errors.Is(err, ErrNotExist))
+	})
+
+	t.Run("IfNotExistConcurrent", func(t *testing.T) {
+		// Both uploads pass the check on create and race to complete
+		files := make([]*File, 2)
+		for i := range files {
+			dst, err := bucket.CreateWithOptions("/docs/concurrent.txt", CreateOptions{IfNotExist: true})
+			require.Nil(t, err)
+			_, err = dst.Write([]byte("concurrent"))
+			require.Nil(t, err)
+			files[i] = dst
+		}
+
+		errs := make([]error, len(files))
+		var wg sync.WaitGroup
+		for i, dst := range files {
+			wg.Add(1)
+			go func(i int, dst *File) {
+				defer wg.Done()
+				errs[i] = dst.Close()
+			}(i, dst)
+		}
+		wg.Wait()
+
+		var won, failed int
+		for _, err := range errs {
+			if err == nil {
+				won++
+			} else if errors.Is(err, ErrPreconditionFailed) {
+				failed++
+			}
+		}
+		assert.Equal(t, 1, won)
+		assert.Equal(t, 1, failed)
+
+		revisions, err := bucket.Revisions("/docs/concurrent.txt")
+		require.Nil(t, err)
+		assert.Len(t, revisions, 1)
+	})
+
+	t.Run("IfLatestID", func(t *testing.T) {
+		latest, err := bucket.Open("/docs/lipsum.txt")
+		require.Nil(t, err)
+
+		second, err := upload(CreateOptions{IfLatestID: latest.ID})
+		require.Nil(t, err)
+
+		_, err = upload(CreateOptions{IfLatestID: latest.ID})
+		assert.True(t, errors.Is(err, ErrPreconditionFailed))
+
+		file, err := bucket.Open("/docs/lipsum.txt")
+		require.Nil(t, err)
+		assert.Equal(t, second.ID, file.ID)
+	})
+
+	t.Run("ErrInvalid", func(t *testing.T) {
+		_, err := bucket.CreateWithOptions("/docs/lipsum.txt", CreateOptions{
+			IfNotExist: true,
+			IfLatestID: "abc",
+		})
+		assert.True(t, errors.Is(err, ErrInvalid))
+	})
+
+	t.Run("Durability", func(t *testing.T) {
+		dst, err := upload(CreateOptions{
+			ChunkSizeBytes: 100,
+			Durability:     DurabilitySoft,
+		})
+		require.Nil(t, err)
+
+		file, err := bucket.OpenID(dst.ID)
+		require.Nil(t, err)
+		assert.Equal(t, StatusComplete, file.Status)
+
+		_, err = bucket.CreateWithOptions("/docs/lipsum.txt", CreateOptions{
+			Durability: "fast",
+		})
+		assert.True(t, errors.Is(err, ErrInvalid))
+	})
+
+	t.Run("ChunkSizeAndContentType", func(t *testing.T) {
+		dst, err := upload(CreateOptions{
+			ChunkSizeBytes: 100,
+			ContentType:    "text/plain",
+		})
+		require.Nil(t, err)
+
+		file, err := bucket.OpenID(dst.ID)
+		require.Nil(t, err)
+		assert.Equal(t, 100, file.ChunkSize)
+		assert.Equal(t, "text/plain", file.ContentType)
+
+		count, err := r.DB(db).Table("write_options_chunks").Filter(map[string]interface{}{
+			"file_id": dst.ID,
+		}).Count().Run(session)
+		require.Nil(t, err)
+
+		var n int
+		require.Nil(t, count.One(&n))
+		assert.Equal(t, 15, n)
+	})
+
+	t.Run("ID", func(t *testing.T) {
+		dst, err := upload(CreateOptions{ID: "lipsum"})
+		require.Nil(t, err)
+		assert.Equal(t, "lipsum", dst.ID)
+
+		_, err = upload(CreateOptions{ID: "lipsum"})
+		assert.True(t, errors.Is(err, ErrExist))
+
+		dst, err = upload(CreateOptions{GenerateID: func() (string, error) {
+			return "generated", nil
+		}})
+		require.Nil(t, err)
+		assert.Equal(t, "generated", dst.ID)
+	})
+
+	t.Run("Expected", func(t *testing.T) {
+		length := 1417
+		_, err := upload(CreateOptions{
+			ExpectedLength: &length,
+			ExpectedSha256: "1748f5745c3ef44ba4e1f212069f6e90e29d61bdd320a48c0b06e1255864ed4f",
+		})
+		assert.Nil(t, err)
+
+		length = 1000
+		dst, err := upload(CreateOptions{ExpectedLength: &length})
+		assert.True(t, errors.Is(err, ErrLengthMismatch))
+		_, err = bucket.OpenID(dst.ID)
+		assert.True(t, errors.Is(err, ErrNotExist))
+
+		dst, err = upload(CreateOptions{ExpectedSha256: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"})
+		assert.True(t, errors.Is(err, ErrHashMismatch))
+		_, err = bucket.OpenID(dst.ID)
+		assert.True(t, errors.Is(err, ErrNotExist))
+
+		// An expected length of zero only accepts empty files
+		length = 0
+		dst, err = upload(CreateOptions{ExpectedLength: &length})
+		assert.True(t, errors.Is(err, ErrLengthMismatch))
+
+		empty, err := bucket.CreateWithOptions("/docs/empty.txt", CreateOptions{ExpectedLength: &length})
+		require.Nil(t, err)
+		assert.Nil(t, empty.Close())
+	})
+}
+
+var errUnavailable = errors.New("unavailable")
+
+func TestFileClose(t *testing.T) {
+	bucket := New(session, BucketOptions{
+		DatabaseName: db,
+		BucketName:   "close",
+	})
+	require.Nil(t, bucket.Init())
+
+	dst, err := bucket.Create("/docs/lipsum.txt", nil)
+	require.Nil(t, err)
+	_, err = dst.Write([]byte("lorem ipsum"))
+	require.Nil(t, err)
+	require.Nil(t, dst.Close())
+	finishedAt := dst.FinishedAt
+
+	t.Run("Idempotent", func(t *testing.T) {
+		assert.Nil(t, dst.Close())
+
+		file, err := bucket.OpenID(dst.ID)
+		require.Nil(t, err)
+		assert.True(t, finishedAt.Equal(file.FinishedAt))
+	})
+
+	t.Run("Retry", func(t *testing.T) {
+		// Fail the first attempt to mark the file as complete
+		failed := false
+		bucket := New(session, BucketOptions{
+			DatabaseName: db,
+			BucketName:   "close",
+			QueryHooks: []QueryHook{QueryHookFunc(func(ctx context.Context, info QueryInfo, next func(context.Context) error) error {
+				if info.Op == "complete_file" && !failed {
+					failed = true
+					return errUnavailable
+				}
+				return next(ctx)
+			})},
+		})
+
+		dst, err := bucket.Create("/docs/retry.txt", nil)
+		require.Nil(t, err)
+		_, err = dst.Write([]byte("lorem ipsum"))
+		require.Nil(t, err)
+		assert.True(t, errors.Is(dst.Close(), errUnavailable))
+
+		_, err = dst.Write([]byte("dolor"))
+		assert.True(t, errors.Is(err, ErrClosed))
+
+		require.Nil(t, dst.Close())
+		file, err := bucket.Open("/docs/retry.txt")
+		require.Nil(t, err)
+		assert.Equal(t, dst.ID, file.ID)
+		data, err := ioutil.ReadAll(file)
+		require.Nil(t, err)
+		assert.Equal(t, []byte("lorem ipsum"), data)
+	})
+
+	t.Run("WriteAfterClose", func(t *testing.T) {
+		_, err := dst.Write([]byte("dolor"))
+		assert.True(t, errors.Is(err, ErrClosed))
+	})
+
+	t.Run("CloseUnread", func(t *testing.T) {
+		file, err := bucket.Open("/docs/lipsum.txt")
+		require.Nil(t, err)
+		assert.Nil(t, file.Close())
+
+		_, err = file.Read(make([]byte, 10))
+		assert.True(t, errors.Is(err, ErrClosed))
+	})
+
+	t.Run("WriteReadHandle", func(t *testing.T) {
+		file, err := bucket.Open("/docs/lipsum.txt")
+		require.Nil(t, err)
+		defer file.Close()
+
+		_, err = file.Write([]byte("dolor"))
+		assert.True(t, errors.Is(err, ErrReadOnly))
+
+		count, err := r.DB(db).Table("close_chunks").Count().Run(session)
+		require.Nil(t, err)
+		var n int
+		require.Nil(t, count.One(&n))
+		assert.Equal(t, 1, n)
+	})
+
+	t.Run("ReadWriteHandle", func(t *testing.T) {
+		dst, err := bucket.Create("/docs/other.txt", nil)
+		require.Nil(t, err)
+		defer dst.Close()
+
+		_, err = dst.Read(make([]byte, 10))
+		assert.True(t, errors.Is(err, ErrInvalid))
+	})
+}